@@ -3,6 +3,7 @@ package client
 import (
 	"bufio"
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -24,9 +25,12 @@ type Call struct {
 	Seq           uint64
 	ServiceMethod string
 	Args          any
+	Metadata      codec.Metadata
+	// Deadline is sent to the server when it is set
+	Deadline time.Time
 	// response message from server
-	Reply         any
-	Error         error
+	Reply any
+	Error error
 	// Done supports for asynchronous calls
 	Done chan *Call
 }
@@ -53,10 +57,15 @@ type Client struct {
 	// pending stores not processed requests,
 	// key is seq, value is instance of Call
 	pending map[uint64]*Call
+	// streams stores the streams not ended yet, key is seq
+	streams map[uint64]*Stream
 	// closing denotes user actively closes the Client
 	closing bool
 	// shutdown denotes there is an error cause Client shut down
 	shutdown bool
+	// draining denotes the server is shutting down, the pending
+	// requests are still served but no new one is accepted
+	draining bool
 }
 
 type clientResult struct {
@@ -84,13 +93,13 @@ func (client *Client) Close() error {
 func (client *Client) IsAvailable() bool {
 	client.mu.Lock()
 	defer client.mu.Unlock()
-	return !client.shutdown && !client.closing
+	return !client.shutdown && !client.closing && !client.draining
 }
 
 func (client *Client) registerCall(call *Call) (uint64, error) {
 	client.mu.Lock()
 	defer client.mu.Unlock()
-	if client.closing || client.shutdown {
+	if client.closing || client.shutdown || client.draining {
 		return 0, ErrShutdown
 	}
 	call.Seq = client.seq
@@ -117,13 +126,18 @@ func (client *Client) terminateCall(err error) {
 		call.Error = err
 		call.done()
 	}
+	for seq, s := range client.streams {
+		delete(client.streams, seq)
+		s.finish(err)
+	}
 }
 
 // receive process
 // call is non-exist
 // call is exist
-// 		server occurs error, h.Error != nil
-// 		server is normal, need to read body form Reply
+//
+//	server occurs error, h.Error != nil
+//	server is normal, need to read body form Reply
 func (client *Client) receive() {
 	var err error
 	for err == nil {
@@ -131,18 +145,29 @@ func (client *Client) receive() {
 		if err = client.cc.ReadHeader(&h); err != nil {
 			break
 		}
+		if h.Kind == codec.KindGoAway {
+			client.mu.Lock()
+			client.draining = true
+			client.mu.Unlock()
+			err = client.cc.ReadBody(nil)
+			continue
+		}
+		if s := client.stream(h.Seq); s != nil {
+			err = client.receiveStream(s, &h)
+			continue
+		}
 		call := client.removeCall(h.Seq)
 		switch {
 		case call == nil:
 			err = client.cc.ReadBody(nil)
 		case h.Error != "":
-			call.Error = fmt.Errorf(h.Error)
+			call.Error = responseError(&h)
 			err = client.cc.ReadBody(nil)
 			call.done()
 		default:
 			err := client.cc.ReadBody(call.Reply)
 			if err != nil {
-				call.Error = errors.New("reading body " + err.Error())
+				call.Error = fmt.Errorf("reading body: %w", err)
 			}
 			call.done()
 		}
@@ -151,18 +176,139 @@ func (client *Client) receive() {
 }
 
 func NewClient(conn net.Conn, opt *server.Option) (*Client, error) {
-	f := codec.NewCodecFuncMap[opt.CodecType]
+	f := codec.Lookup(opt.CodecType)
 	if f == nil {
 		err := fmt.Errorf("invalid codec type %s", opt.CodecType)
 		log.Println("rpc client: codec error:", err)
 		return nil, err
 	}
+	if opt.FrameVersion != 0 && opt.FrameVersion != codec.FrameVersion {
+		err := fmt.Errorf("unsupported frame version %d", opt.FrameVersion)
+		log.Println("rpc client: options error:", err)
+		return nil, err
+	}
+	hc := newHandshakeConn(conn, opt.CodecType)
+	var rwc io.ReadWriteCloser = hc
+	if opt.FrameVersion != 0 {
+		rwc = codec.NewFrameConn(rwc)
+	}
+	rwc, err := codec.Compress(rwc, opt.Compression, opt.CompressThreshold)
+	if err != nil {
+		log.Println("rpc client: options error:", err)
+		return nil, err
+	}
+	rwc = codec.Limit(rwc, opt.MaxHeaderSize, opt.MaxBodySize)
+	if opt.Credentials != nil {
+		opt.AuthScheme = opt.Credentials.Scheme()
+	}
 	if err := json.NewEncoder(conn).Encode(opt); err != nil {
 		log.Println("rpc client: options error:", err)
 		_ = conn.Close()
 		return nil, err
 	}
-	return newClientCodec(f(conn), opt), nil
+	if opt.Credentials != nil {
+		if err := hc.authenticate(opt.Credentials); err != nil {
+			log.Println("rpc client: authentication error:", err)
+			_ = conn.Close()
+			return nil, err
+		}
+	}
+	return newClientCodec(f(rwc), opt), nil
+}
+
+// handshakeConn reads the reply of a server rejecting the codec type,
+// which is sent in place of the first response, as a *server.CodecError.
+// It also runs the authentication before the first response
+type handshakeConn struct {
+	io.ReadWriteCloser
+	r       *bufio.Reader
+	typ     codec.Type
+	checked bool
+	err     error
+}
+
+func newHandshakeConn(conn io.ReadWriteCloser, typ codec.Type) *handshakeConn {
+	return &handshakeConn{ReadWriteCloser: conn, r: bufio.NewReader(conn), typ: typ}
+}
+
+func (c *handshakeConn) Read(p []byte) (int, error) {
+	if !c.checked {
+		c.checked = true
+		c.err = c.check()
+	}
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(p)
+}
+
+func (c *handshakeConn) check() error {
+	// the first byte tells if more are worth waiting for
+	if b, err := c.r.Peek(1); err != nil || b[0] != server.CodecErrorPrefix[0] {
+		return nil
+	}
+	if b, err := c.r.Peek(len(server.CodecErrorPrefix)); err != nil || string(b) != server.CodecErrorPrefix {
+		return nil
+	}
+	var reply handshakeReply
+	if err := json.NewDecoder(c.r).Decode(&reply); err != nil {
+		return err
+	}
+	return c.replyError(&reply)
+}
+
+// handshakeReply is any of the JSON lines the server sends before
+// the responses
+type handshakeReply struct {
+	Challenge []byte
+	Error     string
+	Code      server.Code
+	Codecs    []codec.Type
+}
+
+func (c *handshakeConn) replyError(reply *handshakeReply) error {
+	switch {
+	case reply.Codecs != nil:
+		return &server.CodecError{Type: c.typ, Codecs: reply.Codecs}
+	case reply.Code != server.CodeOK:
+		return &server.Error{Code: reply.Code, Message: reply.Error}
+	}
+	return messageError(reply.Error)
+}
+
+// authenticate answers the challenge of the server with creds, the
+// lines are read one by one as the responses follow them
+func (c *handshakeConn) authenticate(creds server.Credentials) error {
+	var reply handshakeReply
+	if err := c.readReply(&reply); err != nil {
+		return err
+	}
+	if reply.Error != "" {
+		return c.replyError(&reply)
+	}
+	response, err := creds.Respond(reply.Challenge)
+	if err != nil {
+		return err
+	}
+	if err := json.NewEncoder(c.ReadWriteCloser).Encode(&struct{ Response []byte }{response}); err != nil {
+		return err
+	}
+	reply = handshakeReply{}
+	if err := c.readReply(&reply); err != nil {
+		return err
+	}
+	if reply.Error != "" {
+		return c.replyError(&reply)
+	}
+	return nil
+}
+
+func (c *handshakeConn) readReply(reply *handshakeReply) error {
+	line, err := c.r.ReadBytes('\n')
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(line, reply)
 }
 
 func newClientCodec(cc codec.Codec, opt *server.Option) *Client {
@@ -171,6 +317,7 @@ func newClientCodec(cc codec.Codec, opt *server.Option) *Client {
 		cc:      cc,
 		opt:     opt,
 		pending: make(map[uint64]*Call),
+		streams: make(map[uint64]*Stream),
 	}
 	go client.receive()
 	return client
@@ -196,7 +343,7 @@ func dialTimeout(f newClientFunc, network, addr string, opts ...*server.Option)
 	if err != nil {
 		return nil, err
 	}
-	conn, err := net.DialTimeout(network, addr, opt.ConnectTimeout)
+	conn, err := dial(network, addr, opt)
 	if err != nil {
 		return nil, err
 	}
@@ -224,6 +371,15 @@ func dialTimeout(f newClientFunc, network, addr string, opts ...*server.Option)
 	}
 }
 
+// dial connects to addr, over TLS if opt has a TLS config, in which
+// case the handshake is bounded by the connect timeout too
+func dial(network, addr string, opt *server.Option) (net.Conn, error) {
+	if opt.TLSConfig == nil {
+		return net.DialTimeout(network, addr, opt.ConnectTimeout)
+	}
+	return tls.DialWithDialer(&net.Dialer{Timeout: opt.ConnectTimeout}, network, addr, opt.TLSConfig)
+}
+
 func Dial(network, addr string, opts ...*server.Option) (client *Client, err error) {
 	return dialTimeout(NewClient, network, addr, opts...)
 }
@@ -239,11 +395,7 @@ func (client *Client) send(call *Call) {
 		return
 	}
 
-	client.header.ServiceMethod = call.ServiceMethod
-	client.header.Seq = seq
-	client.header.Error = ""
-
-	if err := client.cc.Write(&client.header, call.Args); err != nil {
+	if err := client.write(seq, codec.KindCall, call); err != nil {
 		call := client.removeCall(seq)
 		if call != nil {
 			call.Error = err
@@ -252,6 +404,25 @@ func (client *Client) send(call *Call) {
 	}
 }
 
+// write sends the request of call as a message of kind under seq,
+// sendLock must be held. A call whose deadline has passed is not sent,
+// the server would handle it without any
+func (client *Client) write(seq uint64, kind codec.Kind, call *Call) error {
+	client.header.ServiceMethod = call.ServiceMethod
+	client.header.Seq = seq
+	client.header.Error = ""
+	client.header.Metadata = call.Metadata
+	client.header.Timeout = 0
+	client.header.Kind = kind
+	if !call.Deadline.IsZero() {
+		client.header.Timeout = time.Until(call.Deadline)
+		if client.header.Timeout <= 0 {
+			return fmt.Errorf("rpc client: call failed: %w", context.DeadlineExceeded)
+		}
+	}
+	return client.cc.Write(&client.header, call.Args)
+}
+
 func (client *Client) Go(serviceName string, args, reply any, done chan *Call) *Call {
 	if done == nil {
 		done = make(chan *Call, 10)
@@ -264,18 +435,62 @@ func (client *Client) Go(serviceName string, args, reply any, done chan *Call) *
 		Reply:         reply,
 		Done:          done,
 	}
-	go client.send(call)
+	if len(client.opt.Interceptors) == 0 {
+		go client.send(call)
+		return call
+	}
+	// the interceptors see an asynchronous call as a synchronous one
+	go func() {
+		call.Error = client.invoke(context.Background(), serviceName, args, reply)
+		call.done()
+	}()
 	return call
 }
 
 func (client *Client) Call(ctx context.Context, serviceMethod string, args, reply any) error {
-	call := client.Go(serviceMethod, args, reply, make(chan *Call, 1))
+	return client.invoke(ctx, serviceMethod, args, reply)
+}
+
+// call sends a request and waits for its reply or the end of ctx,
+// it is the invoker at the end of the interceptor chain
+func (client *Client) call(ctx context.Context, serviceMethod string, args, reply any) error {
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("rpc client: call failed: %w", err)
+	}
+	call := callPool.Get().(*Call)
+	call.ServiceMethod = serviceMethod
+	call.Args = args
+	call.Metadata = metadataFromContext(ctx)
+	call.Reply = reply
+	call.Deadline, _ = ctx.Deadline()
+	client.send(call)
 	select {
 	case <-ctx.Done():
-		client.removeCall(call.Seq)
-		return errors.New("rpc client: call failed: " + ctx.Err().Error())
+		// receive may still complete call, so it is not reused
+		if client.removeCall(call.Seq) != nil {
+			client.cancel(call.Seq)
+		}
+		return fmt.Errorf("rpc client: call failed: %w", ctx.Err())
 	case call := <-call.Done:
-		return call.Error
+		err := call.Error
+		*call = Call{Done: call.Done}
+		callPool.Put(call)
+		return err
+	}
+}
+
+// callPool holds the calls of call, which never leave the client
+var callPool = sync.Pool{
+	New: func() any { return &Call{Done: make(chan *Call, 1)} },
+}
+
+// cancel tells the server to abort the request of seq,
+// the server won't send its response
+func (client *Client) cancel(seq uint64) {
+	client.sendLock.Lock()
+	defer client.sendLock.Unlock()
+	if err := client.write(seq, codec.KindCancel, &Call{Args: struct{}{}}); err != nil {
+		log.Println("rpc client: cancel error:", err)
 	}
 }
 
@@ -0,0 +1,52 @@
+package client
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/i0Ek3/rpcie/codec"
+	"github.com/i0Ek3/rpcie/server"
+)
+
+func BenchmarkClientCall(b *testing.B) {
+	var bar Bar
+	s := server.NewServer()
+	_ = s.Register(&bar)
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	go s.Accept(l)
+	defer func() { _ = s.Close() }()
+
+	for _, opt := range []*server.Option{
+		{CodecType: codec.GobType},
+		{CodecType: codec.GobType, FrameVersion: codec.FrameVersion},
+		{CodecType: codec.GobType, FrameVersion: codec.FrameVersion, Compression: codec.CompressionGzip, CompressThreshold: 1},
+	} {
+		name := string(opt.CodecType)
+		if opt.FrameVersion != 0 {
+			name += " framed"
+		}
+		if opt.Compression != "" {
+			name += " " + string(opt.Compression)
+		}
+		b.Run(name, func(b *testing.B) {
+			client, err := Dial("tcp", l.Addr().String(), opt)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer func() { _ = client.Close() }()
+			ctx := context.Background()
+			b.ReportAllocs()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				var reply int
+				for pb.Next() {
+					if err := client.Call(ctx, "Bar.Double", 21, &reply); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
@@ -2,7 +2,17 @@ package client
 
 import (
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"math/big"
 	"net"
 	"os"
 	"runtime"
@@ -10,6 +20,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/i0Ek3/rpcie/codec"
 	"github.com/i0Ek3/rpcie/server"
 )
 
@@ -46,6 +57,98 @@ func (b Bar) Timeout(argv int, reply *int) error {
 	return nil
 }
 
+func (b Bar) Double(argv int, reply *int) error {
+	*reply = argv * 2
+	return nil
+}
+
+func (b Bar) Metadata(ctx context.Context, key string, reply *string) error {
+	*reply = server.MetadataFromContext(ctx)[key]
+	return nil
+}
+
+func (b Bar) Sleep(ms int, reply *int) error {
+	time.Sleep(time.Duration(ms) * time.Millisecond)
+	*reply = ms
+	return nil
+}
+
+// Count sends 0 to n-1 to the client
+func (b Bar) Count(n int, stream *server.Stream) error {
+	for i := 0; i < n; i++ {
+		if err := stream.Send(i); err != nil {
+			return err
+		}
+	}
+	if n < 0 {
+		return errors.New("negative count")
+	}
+	return nil
+}
+
+// Echo sends back the messages of the client doubled
+func (b Bar) Echo(first int, stream *server.Stream) error {
+	for n := first; ; {
+		if err := stream.Send(n * 2); err != nil {
+			return err
+		}
+		if err := stream.Recv(&n); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+var idleErr = make(chan error, 1)
+
+// Idle never receives the messages of the client
+func (b Bar) Idle(first int, stream *server.Stream) error {
+	<-stream.Context().Done()
+	idleErr <- stream.Context().Err()
+	return stream.Context().Err()
+}
+
+var waitErr = make(chan error, 1)
+
+// Wait blocks until the call is cancelled by the client
+func (b Bar) Wait(ctx context.Context, argv int, reply *int) error {
+	<-ctx.Done()
+	waitErr <- ctx.Err()
+	return ctx.Err()
+}
+
+// Identity replies the common name of the verified client certificate
+func (b Bar) Identity(ctx context.Context, argv int, reply *string) error {
+	if cert := server.PeerFromContext(ctx).Certificate(); cert != nil {
+		*reply = cert.Subject.CommonName
+	}
+	return nil
+}
+
+// Validate fails with a coded error for a negative argv
+func (b Bar) Validate(argv int, reply *int) error {
+	if argv < 0 {
+		return &server.Error{Code: server.CodeInvalidArgument, Message: "argv must not be negative", Details: codec.Metadata{"argv": fmt.Sprint(argv)}}
+	}
+	*reply = argv
+	return nil
+}
+
+// Whoami replies the identity the client authenticated as
+func (b Bar) Whoami(ctx context.Context, argv int, reply *string) error {
+	*reply = server.PeerFromContext(ctx).Identity
+	return nil
+}
+
+// Deadline replies the time left before the deadline of the call
+func (b Bar) Deadline(ctx context.Context, argv int, reply *time.Duration) error {
+	if deadline, ok := ctx.Deadline(); ok {
+		*reply = time.Until(deadline)
+	}
+	return nil
+}
+
 func startServer(addr chan string) {
 	var b Bar
 	_ = server.Register(&b)
@@ -68,6 +171,31 @@ func TestClientCall(t *testing.T) {
 		err := client.Call(ctx, "Bar.Timeout", 1, &reply)
 		_assert(err != nil && strings.Contains(err.Error(), ctx.Err().Error()), "expect a timeout error")
 	})
+	t.Run("deadline propagation", func(t *testing.T) {
+		client, _ := Dial("tcp", addr)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		var left time.Duration
+		err := client.Call(ctx, "Bar.Deadline", 1, &left)
+		_assert(err == nil && left > 0 && left <= time.Second, "expect the server to see the client deadline, got %s", left)
+	})
+	t.Run("deadline passed before sending", func(t *testing.T) {
+		client, _ := Dial("tcp", addr)
+		var reply int
+		call := &Call{ServiceMethod: "Bar.Wait", Args: 1, Reply: &reply, Deadline: time.Now(), Done: make(chan *Call, 1)}
+		client.send(call)
+		<-call.Done
+		_assert(errors.Is(call.Error, context.DeadlineExceeded), "expect the call to fail without being sent, got %v", call.Error)
+	})
+	t.Run("client cancel", func(t *testing.T) {
+		client, _ := Dial("tcp", addr)
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(100*time.Millisecond, cancel)
+		var reply int
+		err := client.Call(ctx, "Bar.Wait", 1, &reply)
+		_assert(err != nil && strings.Contains(err.Error(), "canceled"), "expect a cancel error")
+		_assert(<-waitErr == context.Canceled, "expect the server to abort the call")
+	})
 	t.Run("server handle timeout", func(t *testing.T) {
 		client, _ := Dial("tcp", addr, &server.Option{
 			HandleTimeout: time.Second,
@@ -78,6 +206,181 @@ func TestClientCall(t *testing.T) {
 	})
 }
 
+func TestClientInterceptor(t *testing.T) {
+	t.Parallel()
+	addrCh := make(chan string)
+	go startServer(addrCh)
+	addr := <-addrCh
+
+	var trace []string
+	client, err := Dial("tcp", addr, &server.Option{
+		Interceptors: []server.UnaryClientInterceptor{
+			func(ctx context.Context, serviceMethod string, args, reply any, invoker server.UnaryInvoker) error {
+				trace = append(trace, "outer:"+serviceMethod)
+				return invoker(ctx, serviceMethod, args, reply)
+			},
+			func(ctx context.Context, serviceMethod string, args, reply any, invoker server.UnaryInvoker) error {
+				trace = append(trace, "inner")
+				if args.(int) < 0 {
+					return errors.New("negative argument")
+				}
+				return invoker(ctx, serviceMethod, args.(int)+1, reply)
+			},
+		},
+	})
+	_assert(err == nil, "failed to dial: %v", err)
+	defer func() { _ = client.Close() }()
+
+	var reply int
+	err = client.Call(context.Background(), "Bar.Double", 1, &reply)
+	_assert(err == nil && reply == 4, "expect the interceptor to rewrite args, got %d, %v", reply, err)
+	_assert(len(trace) == 2 && trace[0] == "outer:Bar.Double" && trace[1] == "inner", "wrong interceptor order: %v", trace)
+
+	call := <-client.Go("Bar.Double", -1, &reply, nil).Done
+	_assert(call.Error != nil && call.Error.Error() == "negative argument", "expect Go to run the interceptors")
+}
+
+func TestClientMetadata(t *testing.T) {
+	t.Parallel()
+	addrCh := make(chan string)
+	go startServer(addrCh)
+	client, _ := Dial("tcp", <-addrCh)
+	defer func() { _ = client.Close() }()
+
+	ctx := WithMetadata(context.Background(), codec.Metadata{"tenant": "rpcie", "trace": "1"})
+	ctx = WithMetadata(ctx, codec.Metadata{"trace": "2"})
+	var tenant, trace string
+	_ = client.Call(ctx, "Bar.Metadata", "tenant", &tenant)
+	_ = client.Call(ctx, "Bar.Metadata", "trace", &trace)
+	_assert(tenant == "rpcie" && trace == "2", "expect metadata from context, got %q and %q", tenant, trace)
+}
+
+func TestServerShutdown(t *testing.T) {
+	t.Parallel()
+	var b Bar
+	serve := func() (*server.Server, string) {
+		srv := server.NewServer()
+		_ = srv.Register(&b)
+		l, _ := net.Listen("tcp", ":0")
+		go srv.Accept(l)
+		return srv, l.Addr().String()
+	}
+	t.Run("graceful", func(t *testing.T) {
+		srv, addr := serve()
+		client, _ := Dial("tcp", addr)
+		call := client.Go("Bar.Sleep", 500, new(int), nil)
+		time.Sleep(100 * time.Millisecond)
+		err := srv.Shutdown(context.Background())
+		_assert(err == nil, "expect a graceful shutdown, got %v", err)
+		call = <-call.Done
+		_assert(call.Error == nil && *call.Reply.(*int) == 500, "expect the call in flight to finish")
+		_assert(!client.IsAvailable(), "expect the client to stop sending requests")
+		_, err = Dial("tcp", addr)
+		_assert(err != nil, "expect the server to stop accepting")
+	})
+	t.Run("force", func(t *testing.T) {
+		srv, addr := serve()
+		client, _ := Dial("tcp", addr)
+		call := client.Go("Bar.Sleep", 2000, new(int), nil)
+		time.Sleep(100 * time.Millisecond)
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		err := srv.Shutdown(ctx)
+		_assert(err == context.DeadlineExceeded, "expect the shutdown to time out, got %v", err)
+		call = <-call.Done
+		_assert(call.Error != nil, "expect the connection to be closed")
+	})
+}
+
+func TestClientStream(t *testing.T) {
+	t.Parallel()
+	addrCh := make(chan string)
+	go startServer(addrCh)
+	client, _ := Dial("tcp", <-addrCh)
+	defer func() { _ = client.Close() }()
+
+	t.Run("server stream", func(t *testing.T) {
+		stream, err := client.NewStream(context.Background(), "Bar.Count", 5, new(int))
+		_assert(err == nil, "failed to open stream: %v", err)
+		var got []int
+		for {
+			var n int
+			if err = stream.Recv(&n); err != nil {
+				break
+			}
+			// ordinary calls share the connection with the stream
+			var reply int
+			_ = client.Call(context.Background(), "Bar.Double", n, &reply)
+			got = append(got, reply)
+		}
+		_assert(err == io.EOF && len(got) == 5 && got[4] == 8, "expect 5 messages then io.EOF, got %v, %v", got, err)
+	})
+	t.Run("invalid reply", func(t *testing.T) {
+		for _, reply := range []any{nil, 0} {
+			_, err := client.NewStream(context.Background(), "Bar.Count", 1, reply)
+			_assert(err != nil, "expect an error for the reply %v", reply)
+		}
+	})
+	t.Run("error frame", func(t *testing.T) {
+		stream, _ := client.NewStream(context.Background(), "Bar.Count", -1, new(int))
+		var n int
+		err := stream.Recv(&n)
+		_assert(err != nil && err.Error() == "negative count", "expect the error of the method, got %v", err)
+	})
+	t.Run("bidirectional", func(t *testing.T) {
+		stream, _ := client.NewStream(context.Background(), "Bar.Echo", 1, new(int))
+		var n int
+		for i := 2; i <= 3; i++ {
+			_ = stream.Recv(&n)
+			_ = stream.Send(i)
+		}
+		_ = stream.Recv(&n)
+		_assert(n == 6, "expect the last message doubled, got %d", n)
+		_ = stream.CloseSend()
+		_assert(stream.Recv(&n) == io.EOF, "expect the stream to end")
+	})
+	t.Run("invalid message", func(t *testing.T) {
+		stream, _ := client.NewStream(context.Background(), "Bar.Echo", 1, new(int))
+		var n int
+		_ = stream.Recv(&n)
+		_ = stream.Send("two")
+		err := stream.Recv(&n)
+		_assert(Code(err) == server.CodeInvalidArgument, "expect the stream to fail, got %s %v", Code(err), err)
+	})
+	t.Run("server overflow", func(t *testing.T) {
+		stream, _ := client.NewStream(context.Background(), "Bar.Idle", 0, new(int))
+		defer func() { _ = stream.Close() }()
+		for i := 0; i < 200; i++ {
+			_ = stream.Send(i)
+		}
+		// the connection is still read by the server
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		var reply, n int
+		err := client.Call(ctx, "Bar.Double", 1, &reply)
+		_assert(err == nil && reply == 2, "expect the call to be answered, got %v", err)
+		err = stream.Recv(&n)
+		_assert(errors.Is(err, server.ErrStreamOverflow), "expect the stream to overflow, got %v", err)
+		_assert(<-idleErr == context.Canceled, "expect the method to be cancelled")
+	})
+	t.Run("client overflow", func(t *testing.T) {
+		stream, _ := client.NewStream(context.Background(), "Bar.Count", 200, new(int))
+		defer func() { _ = stream.Close() }()
+		time.Sleep(100 * time.Millisecond)
+		// the connection is still read by the client
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		var reply, n int
+		err := client.Call(ctx, "Bar.Double", 1, &reply)
+		_assert(err == nil && reply == 2, "expect the call to be answered, got %v", err)
+		var received int
+		for err = stream.Recv(&n); err == nil; err = stream.Recv(&n) {
+			received++
+		}
+		_assert(err == ErrStreamOverflow && received == streamBuffer, "expect the buffered messages then an overflow, got %d, %v", received, err)
+	})
+}
+
 func XDial(rpcAddr string, opts ...*server.Option) (*Client, error) {
 	parts := strings.Split(rpcAddr, "@")
 	if len(parts) != 2 {
@@ -111,3 +414,265 @@ func TestXDial(t *testing.T) {
 		_assert(err == nil, "failed to connect unix socket")
 	}
 }
+
+func TestCborCodec(t *testing.T) {
+	var b Bar
+	s := server.NewServer()
+	_ = s.Register(&b)
+	addr := t.TempDir() + "/rpcie.sock"
+	l, err := net.Listen("unix", addr)
+	_assert(err == nil, "failed to listen unix socket: %v", err)
+	go s.Accept(l)
+	defer func() { _ = s.Close() }()
+
+	for _, frameVersion := range []uint8{0, codec.FrameVersion} {
+		client, err := Dial("unix", addr, &server.Option{CodecType: codec.CborType, FrameVersion: frameVersion})
+		_assert(err == nil, "failed to dial: %v", err)
+		var reply int
+		err = client.Call(context.Background(), "Bar.Double", 21, &reply)
+		_assert(err == nil && reply == 42, "failed to call Bar.Double over cbor: %v", err)
+		err = client.Call(context.Background(), "Bar.Missing", 21, &reply)
+		_assert(err != nil && client.IsAvailable(), "expect an error response on a live connection: %v", err)
+		_ = client.Close()
+	}
+}
+
+func TestCodecError(t *testing.T) {
+	conn, srvConn := net.Pipe()
+	defer func() { _ = srvConn.Close() }()
+	go func() {
+		var opt server.Option
+		_ = json.NewDecoder(srvConn).Decode(&opt)
+		_, _ = io.WriteString(srvConn, `{"Error":"rpc server: invalid codec type","Codecs":["application/gob"]}`+"\n")
+		_, _ = io.Copy(io.Discard, srvConn)
+	}()
+	client, err := NewClient(conn, &server.Option{MagicNumber: server.MagicNumber, CodecType: codec.JsonType})
+	_assert(err == nil, "failed to create client: %v", err)
+	var reply int
+	err = client.Call(context.Background(), "Bar.Double", 1, &reply)
+	var codecErr *server.CodecError
+	_assert(errors.As(err, &codecErr), "expect a codec error, got %v", err)
+	_assert(codecErr.Type == codec.JsonType && len(codecErr.Codecs) == 1 && codecErr.Codecs[0] == codec.GobType,
+		"wrong codec error %v", codecErr)
+}
+
+func TestClientRateLimited(t *testing.T) {
+	t.Parallel()
+	var b Bar
+	srv := server.NewServer()
+	_ = srv.Register(&b)
+	srv.RateLimiters = []server.RateLimiter{server.NewRateLimiter(server.ByMetadata("tenant"), 0.01, 1)}
+	l, _ := net.Listen("tcp", ":0")
+	go srv.Accept(l)
+	defer func() { _ = srv.Close() }()
+	client, _ := Dial("tcp", l.Addr().String())
+	defer func() { _ = client.Close() }()
+
+	noisy := WithMetadata(context.Background(), codec.Metadata{"tenant": "noisy"})
+	var reply int
+	err := client.Call(noisy, "Bar.Double", 1, &reply)
+	_assert(err == nil && reply == 2, "expect the first call to pass: %v", err)
+	err = client.Call(noisy, "Bar.Double", 1, &reply)
+	_assert(errors.Is(err, server.ErrRateLimited), "expect the client to recognise the rate limit, got %v", err)
+	quiet := WithMetadata(context.Background(), codec.Metadata{"tenant": "quiet"})
+	err = client.Call(quiet, "Bar.Double", 1, &reply)
+	_assert(err == nil, "expect the other tenant not to be limited: %v", err)
+}
+
+// newCert issues a certificate for name signed by parent, or a self-signed
+// CA if parent is nil
+func newCert(name string, parent *tls.Certificate) tls.Certificate {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	signer, signerKey := tmpl, any(key)
+	if parent == nil {
+		tmpl.IsCA, tmpl.BasicConstraintsValid = true, true
+		tmpl.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		signer, signerKey = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	_assert(err == nil, "failed to create certificate: %v", err)
+	leaf, _ := x509.ParseCertificate(der)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func TestTLS(t *testing.T) {
+	t.Parallel()
+	ca := newCert("rpcie ca", nil)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Leaf)
+	serverCert, clientCert := newCert("server", &ca), newCert("client", &ca)
+
+	var b Bar
+	srv := server.NewServer()
+	_ = srv.Register(&b)
+	srv.TLSConfig = &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	go srv.Accept(l)
+	defer func() { _ = srv.Close() }()
+	addr := l.Addr().String()
+
+	opt := &server.Option{TLSConfig: &tls.Config{RootCAs: pool, Certificates: []tls.Certificate{clientCert}}}
+	t.Run("mutual", func(t *testing.T) {
+		client, err := XDial("tcp@"+addr, opt)
+		_assert(err == nil, "failed to dial over tls: %v", err)
+		defer func() { _ = client.Close() }()
+		var name string
+		err = client.Call(context.Background(), "Bar.Identity", 0, &name)
+		_assert(err == nil && name == "client", "expect the verified client identity, got %q %v", name, err)
+		err = client.Call(context.Background(), "Bar.Whoami", 0, &name)
+		_assert(err == nil && name == "client", "expect the certificate to name the peer, got %q %v", name, err)
+	})
+	t.Run("no client certificate", func(t *testing.T) {
+		client, err := Dial("tcp", addr, &server.Option{TLSConfig: &tls.Config{RootCAs: pool}, ConnectTimeout: time.Second})
+		if err == nil {
+			// the server may reject the certificate after the client is done
+			var reply int
+			err = client.Call(context.Background(), "Bar.Double", 1, &reply)
+		}
+		_assert(err != nil, "expect the server to require a certificate")
+	})
+	t.Run("unknown server", func(t *testing.T) {
+		_, err := Dial("tcp", addr, &server.Option{TLSConfig: &tls.Config{Certificates: []tls.Certificate{clientCert}}})
+		_assert(err != nil, "expect the client to reject an unknown server")
+	})
+	t.Run("plaintext", func(t *testing.T) {
+		client, err := Dial("tcp", addr)
+		_assert(err == nil, "failed to dial: %v", err)
+		defer func() { _ = client.Close() }()
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		var reply int
+		err = client.Call(ctx, "Bar.Double", 1, &reply)
+		_assert(err != nil, "expect the server to reject a plaintext client")
+	})
+}
+
+func TestAuthentication(t *testing.T) {
+	t.Parallel()
+	serve := func(auth server.Authenticator) string {
+		var b Bar
+		srv := server.NewServer()
+		_ = srv.Register(&b)
+		srv.Authenticator = auth
+		l, _ := net.Listen("tcp", "127.0.0.1:0")
+		go srv.Accept(l)
+		t.Cleanup(func() { _ = srv.Close() })
+		return l.Addr().String()
+	}
+	whoami := func(addr string, creds server.Credentials) (string, error) {
+		client, err := Dial("tcp", addr, &server.Option{Credentials: creds, ConnectTimeout: time.Second})
+		if err != nil {
+			return "", err
+		}
+		defer func() { _ = client.Close() }()
+		var identity string
+		err = client.Call(context.Background(), "Bar.Whoami", 0, &identity)
+		return identity, err
+	}
+
+	tokens := serve(&server.TokenAuthenticator{Tokens: map[string]string{"s3cret": "alice"}})
+	hmacs := serve(&server.HMACAuthenticator{Keys: map[string][]byte{"bob": []byte("key")}})
+	open := serve(nil)
+	for _, tt := range []struct {
+		name     string
+		addr     string
+		creds    server.Credentials
+		identity string
+		err      error
+	}{
+		{"token", tokens, server.TokenCredentials("s3cret"), "alice", nil},
+		{"wrong token", tokens, server.TokenCredentials("guess"), "", server.ErrUnauthenticated},
+		{"hmac", hmacs, &server.HMACCredentials{Identity: "bob", Key: []byte("key")}, "bob", nil},
+		{"wrong hmac key", hmacs, &server.HMACCredentials{Identity: "bob", Key: []byte("guess")}, "", server.ErrUnauthenticated},
+		{"unknown hmac identity", hmacs, &server.HMACCredentials{Identity: "eve", Key: []byte("key")}, "", server.ErrUnauthenticated},
+		{"wrong scheme", hmacs, server.TokenCredentials("s3cret"), "", server.ErrUnauthenticated},
+		{"no credentials", tokens, nil, "", server.ErrUnauthenticated},
+		{"unexpected credentials", open, server.TokenCredentials("s3cret"), "", server.ErrUnauthenticated},
+		{"no authentication", open, nil, "", nil},
+	} {
+		identity, err := whoami(tt.addr, tt.creds)
+		_assert(errors.Is(err, tt.err) && identity == tt.identity, "%s: expect %q %v, got %q %v", tt.name, tt.identity, tt.err, identity, err)
+	}
+}
+
+func TestAuthorization(t *testing.T) {
+	t.Parallel()
+	var b Bar
+	srv := server.NewServer()
+	_ = srv.Register(&b)
+	srv.Authenticator = &server.TokenAuthenticator{Tokens: map[string]string{"s3cret": "alice"}}
+	srv.Authorizer = &server.Policy{Rules: []server.Rule{{Identities: []string{"alice"}, Methods: []string{"Bar.Double"}, Allow: true}}}
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	go srv.Accept(l)
+	defer func() { _ = srv.Close() }()
+	client, err := Dial("tcp", l.Addr().String(), &server.Option{Credentials: server.TokenCredentials("s3cret")})
+	_assert(err == nil, "failed to dial: %v", err)
+	defer func() { _ = client.Close() }()
+
+	var reply int
+	err = client.Call(context.Background(), "Bar.Double", 2, &reply)
+	_assert(err == nil && reply == 4, "expect alice to call Bar.Double: %v", err)
+	var identity string
+	err = client.Call(context.Background(), "Bar.Whoami", 0, &identity)
+	_assert(errors.Is(err, server.ErrPermissionDenied) && strings.Contains(err.Error(), `"alice"`),
+		"expect a denial with its reason, got %v", err)
+}
+
+func TestErrorCodes(t *testing.T) {
+	t.Parallel()
+	addrCh := make(chan string)
+	go startServer(addrCh)
+	client, _ := Dial("tcp", <-addrCh)
+	defer func() { _ = client.Close() }()
+
+	var reply int
+	err := client.Call(context.Background(), "Bar.Validate", -1, &reply)
+	var e *server.Error
+	_assert(errors.As(err, &e) && e.Code == server.CodeInvalidArgument && e.Message == "argv must not be negative",
+		"expect the error of the method, got %#v", err)
+	_assert(Details(err)["argv"] == "-1", "expect the details, got %v", Details(err))
+	_assert(errors.Is(err, &server.Error{Code: server.CodeInvalidArgument}), "expect errors.Is to match the code")
+
+	err = client.Call(context.Background(), "Bar.Missing", 1, &reply)
+	_assert(Code(err) == server.CodeNotFound, "expect not found, got %s %v", Code(err), err)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err = client.Call(ctx, "Bar.Sleep", 500, &reply)
+	_assert(Code(err) == server.CodeDeadlineExceeded && errors.Is(err, context.DeadlineExceeded),
+		"expect the deadline to be recognised, got %s %v", Code(err), err)
+	err = client.Call(context.Background(), "Bar.Double", 1, &reply)
+	_assert(err == nil && Code(err) == server.CodeOK, "expect no error, got %v", err)
+
+	legacy := messageError(server.ErrPermissionDenied.Error() + ": Bar.Double is denied")
+	_assert(Code(legacy) == server.CodePermissionDenied && errors.Is(legacy, server.ErrPermissionDenied),
+		"expect the errors of older servers to be recognised, got %v", legacy)
+	_assert(Code(errors.New("plain")) == server.CodeUnknown, "expect other errors to be unknown")
+}
+
+func TestResponseTooLarge(t *testing.T) {
+	t.Parallel()
+	addrCh := make(chan string)
+	go startServer(addrCh)
+	client, _ := Dial("tcp", <-addrCh, &server.Option{FrameVersion: codec.FrameVersion, MaxBodySize: 16})
+	defer func() { _ = client.Close() }()
+
+	ctx := WithMetadata(context.Background(), codec.Metadata{"large": strings.Repeat("x", 64)})
+	var reply string
+	err := client.Call(ctx, "Bar.Metadata", "large", &reply)
+	_assert(errors.Is(err, codec.ErrBodyTooLarge) && Code(err) == server.CodeTooLarge,
+		"expect the size error of the client, got %s %v", Code(err), err)
+}
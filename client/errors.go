@@ -0,0 +1,74 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/i0Ek3/rpcie/codec"
+	"github.com/i0Ek3/rpcie/server"
+)
+
+// serverErrors are the errors of the server recognised by their
+// message when it sends no code, as the servers predating the codes
+var serverErrors = []error{
+	server.ErrServerClosed,
+	server.ErrServerBusy,
+	server.ErrRateLimited,
+	server.ErrUnauthenticated,
+	server.ErrPermissionDenied,
+}
+
+// responseError returns the error of the response of h as a *server.Error
+func responseError(h *codec.Header) error {
+	if h.Code != 0 {
+		return &server.Error{Code: server.Code(h.Code), Message: h.Error, Details: h.Details}
+	}
+	return messageError(h.Error)
+}
+
+// messageError returns the error sent by the server as msg
+func messageError(msg string) error {
+	for _, err := range serverErrors {
+		if msg == err.Error() {
+			return err
+		}
+		if strings.HasPrefix(msg, err.Error()+": ") {
+			var e *server.Error
+			errors.As(err, &e)
+			return &server.Error{Code: e.Code, Message: msg}
+		}
+	}
+	return errors.New(msg)
+}
+
+// Code returns the code of the error of a call, server.CodeOK for nil
+// and server.CodeUnknown for an error the server didn't classify. The
+// deadline and the cancellation of the context of the call have theirs,
+// as the responses exceeding the size limits of the client
+func Code(err error) server.Code {
+	if err == nil {
+		return server.CodeOK
+	}
+	var e *server.Error
+	switch {
+	case errors.As(err, &e):
+		return e.Code
+	case errors.Is(err, context.DeadlineExceeded):
+		return server.CodeDeadlineExceeded
+	case errors.Is(err, context.Canceled):
+		return server.CodeCanceled
+	case errors.Is(err, codec.ErrHeaderTooLarge), errors.Is(err, codec.ErrBodyTooLarge):
+		return server.CodeTooLarge
+	}
+	return server.CodeUnknown
+}
+
+// Details returns the details of the error of a call, nil if none
+func Details(err error) codec.Metadata {
+	var e *server.Error
+	if errors.As(err, &e) {
+		return e.Details
+	}
+	return nil
+}
@@ -0,0 +1,25 @@
+package client
+
+import (
+	"context"
+
+	"github.com/i0Ek3/rpcie/server"
+)
+
+// Chain composes interceptors into a single one, the first one is the outermost
+func Chain(interceptors ...server.UnaryClientInterceptor) server.UnaryClientInterceptor {
+	return func(ctx context.Context, serviceMethod string, args, reply any, invoker server.UnaryInvoker) error {
+		for i := len(interceptors) - 1; i >= 0; i-- {
+			interceptor, next := interceptors[i], invoker
+			invoker = func(ctx context.Context, serviceMethod string, args, reply any) error {
+				return interceptor(ctx, serviceMethod, args, reply, next)
+			}
+		}
+		return invoker(ctx, serviceMethod, args, reply)
+	}
+}
+
+// invoke makes a call through the interceptors of client
+func (client *Client) invoke(ctx context.Context, serviceMethod string, args, reply any) error {
+	return Chain(client.opt.Interceptors...)(ctx, serviceMethod, args, reply, client.call)
+}
@@ -0,0 +1,27 @@
+package client
+
+import (
+	"context"
+
+	"github.com/i0Ek3/rpcie/codec"
+)
+
+type metadataKey struct{}
+
+// WithMetadata returns a copy of ctx carrying md, which is sent with the
+// calls made with the returned context, pairs attached before are kept
+func WithMetadata(ctx context.Context, md codec.Metadata) context.Context {
+	merged := make(codec.Metadata)
+	for k, v := range metadataFromContext(ctx) {
+		merged[k] = v
+	}
+	for k, v := range md {
+		merged[k] = v
+	}
+	return context.WithValue(ctx, metadataKey{}, merged)
+}
+
+func metadataFromContext(ctx context.Context) codec.Metadata {
+	md, _ := ctx.Value(metadataKey{}).(codec.Metadata)
+	return md
+}
@@ -0,0 +1,213 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"sync"
+
+	"github.com/i0Ek3/rpcie/codec"
+)
+
+// streamBuffer denotes how many messages of a stream can be
+// buffered, the stream fails once Recv lets them pile up
+const streamBuffer = 64
+
+var ErrStreamClosed = errors.New("stream is closed")
+
+// ErrStreamOverflow ends the streams whose messages are not received,
+// the client never waits for Recv to read the connection
+var ErrStreamOverflow = errors.New("stream overflow, the messages are not received")
+
+// Stream denotes the client side of a streaming call, its messages
+// share the connection with ordinary calls under one Seq
+type Stream struct {
+	client        *Client
+	ctx           context.Context
+	seq           uint64
+	serviceMethod string
+	// typ denotes the type of the messages read by Recv
+	typ reflect.Type
+	// msgs is fed by receive and closed with err once the stream ends
+	msgs chan reflect.Value
+	err  error
+	// end is closed with msgs, done is closed by Close
+	end       chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewStream calls a streaming method with args as the first message.
+// reply is a pointer to the type of the messages sent back by the
+// server, it is only used to allocate them. Cancelling ctx closes the
+// stream, so does Close, which must be called if the stream is left
+// before Recv returns an error
+func (client *Client) NewStream(ctx context.Context, serviceMethod string, args, reply any) (*Stream, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("rpc client: call failed: %w", err)
+	}
+	typ := reflect.TypeOf(reply)
+	if typ == nil || typ.Kind() != reflect.Ptr {
+		return nil, fmt.Errorf("rpc client: stream reply must be a pointer, got %T", reply)
+	}
+	s := &Stream{
+		client:        client,
+		ctx:           ctx,
+		serviceMethod: serviceMethod,
+		typ:           typ.Elem(),
+		msgs:          make(chan reflect.Value, streamBuffer),
+		end:           make(chan struct{}),
+		done:          make(chan struct{}),
+	}
+	call := &Call{
+		ServiceMethod: serviceMethod,
+		Args:          args,
+		Metadata:      metadataFromContext(ctx),
+	}
+	call.Deadline, _ = ctx.Deadline()
+
+	client.sendLock.Lock()
+	seq, err := client.registerStream(s)
+	if err == nil {
+		if err = client.write(seq, codec.KindCall, call); err != nil {
+			client.removeStream(seq)
+		}
+	}
+	client.sendLock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = s.Close()
+		case <-s.end:
+		case <-s.done:
+		}
+	}()
+	return s, nil
+}
+
+// Send sends m to the server as the next message of the stream
+func (s *Stream) Send(m any) error {
+	return s.write(codec.KindStream, m)
+}
+
+// CloseSend tells the server no more message will be sent,
+// the messages of the server can still be read
+func (s *Stream) CloseSend() error {
+	return s.write(codec.KindStreamEnd, struct{}{})
+}
+
+func (s *Stream) write(kind codec.Kind, m any) error {
+	select {
+	case <-s.done:
+		return ErrStreamClosed
+	default:
+	}
+	s.client.sendLock.Lock()
+	defer s.client.sendLock.Unlock()
+	return s.client.write(s.seq, kind, &Call{ServiceMethod: s.serviceMethod, Args: m})
+}
+
+// Recv reads the next message sent by the server into m, which must
+// be a pointer to the type of reply given to NewStream. It returns
+// io.EOF once the server ends the stream, or the error of the method
+func (s *Stream) Recv(m any) error {
+	dst := reflect.ValueOf(m)
+	if dst.Kind() != reflect.Ptr || dst.Elem().Type() != s.typ {
+		return fmt.Errorf("rpc client: stream receives %s, got %T", s.typ, m)
+	}
+	select {
+	case v, ok := <-s.msgs:
+		if !ok {
+			return s.err
+		}
+		dst.Elem().Set(v.Elem())
+		return nil
+	case <-s.done:
+		if err := s.ctx.Err(); err != nil {
+			return fmt.Errorf("rpc client: call failed: %w", err)
+		}
+		return ErrStreamClosed
+	}
+}
+
+// Close stops the stream, the server is asked
+// to abort it if it has not ended yet
+func (s *Stream) Close() error {
+	s.closeOnce.Do(func() {
+		if s.client.removeStream(s.seq) != nil {
+			s.client.cancel(s.seq)
+		}
+		close(s.done)
+	})
+	return nil
+}
+
+// finish ends the stream with err, it is only called by receive
+func (s *Stream) finish(err error) {
+	s.err = err
+	close(s.msgs)
+	close(s.end)
+}
+
+func (client *Client) registerStream(s *Stream) (uint64, error) {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	if client.closing || client.shutdown || client.draining {
+		return 0, ErrShutdown
+	}
+	s.seq = client.seq
+	client.streams[s.seq] = s
+	client.seq++
+	return s.seq, nil
+}
+
+func (client *Client) removeStream(seq uint64) *Stream {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	s := client.streams[seq]
+	delete(client.streams, seq)
+	return s
+}
+
+func (client *Client) stream(seq uint64) *Stream {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	return client.streams[seq]
+}
+
+// receiveStream reads a message of s, any response
+// other than a stream message ends the stream
+func (client *Client) receiveStream(s *Stream, h *codec.Header) error {
+	if h.Kind == codec.KindStream {
+		v := reflect.New(s.typ)
+		if err := client.cc.ReadBody(v.Interface()); err != nil {
+			client.removeStream(h.Seq)
+			s.finish(fmt.Errorf("reading body: %w", err))
+			return nil
+		}
+		select {
+		case s.msgs <- v:
+		case <-s.done:
+		default:
+			// the server is asked to stop sending, the messages
+			// buffered can still be read before the error
+			if client.removeStream(h.Seq) != nil {
+				go client.cancel(h.Seq)
+			}
+			s.finish(ErrStreamOverflow)
+		}
+		return nil
+	}
+	client.removeStream(h.Seq)
+	if h.Error != "" {
+		s.finish(responseError(h))
+	} else {
+		s.finish(io.EOF)
+	}
+	return client.cc.ReadBody(nil)
+}
@@ -0,0 +1,72 @@
+package codec
+
+import (
+	"bufio"
+	"io"
+	"log"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+type CborCodec struct {
+	conn io.ReadWriteCloser
+	buf  *bufio.Writer
+	dec  *cbor.Decoder
+	enc  *cbor.Encoder
+}
+
+var _ Codec = (*CborCodec)(nil)
+
+func NewCborCodec(conn io.ReadWriteCloser) Codec {
+	buf := bufio.NewWriter(conn)
+	return &CborCodec{
+		conn: conn,
+		buf:  buf,
+		dec:  cbor.NewDecoder(conn),
+		enc:  cbor.NewEncoder(buf),
+	}
+}
+
+func (c *CborCodec) ReadHeader(h *Header) error {
+	if err := beginHeader(c.conn); err != nil {
+		return err
+	}
+	return c.dec.Decode(h)
+}
+
+func (c *CborCodec) ReadBody(body any) error {
+	if err := beginBody(c.conn); err != nil {
+		return err
+	}
+	if body == nil {
+		var discard cbor.RawMessage
+		return c.dec.Decode(&discard)
+	}
+	return c.dec.Decode(body)
+}
+
+func (c *CborCodec) Write(h *Header, body any) (err error) {
+	f := beginMessage(c.conn)
+	defer func() {
+		if ferr := endMessage(f, c.buf); err == nil {
+			err = ferr
+		}
+		if err != nil {
+			_ = c.Close()
+		}
+	}()
+	if err := c.enc.Encode(h); err != nil {
+		log.Println("rpc codec: cbor error encoding header:", err)
+		return err
+	}
+	endHeader(f, c.buf)
+	if err := c.enc.Encode(body); err != nil {
+		log.Println("rpc codec: cbor error encoding body:", err)
+		return err
+	}
+	return nil
+}
+
+func (c *CborCodec) Close() error {
+	return c.conn.Close()
+}
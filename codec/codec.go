@@ -1,15 +1,53 @@
 package codec
 
-import "io"
+import (
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
 
 type Header struct {
 	// ServiceMethod denotes service name and method name
 	ServiceMethod string
 	// Seq denotes the number id of request
-	Seq   uint64
-	Error string
+	Seq uint64
+	// Error is the message of the error of a response, Code classifies
+	// it, 0 for the peers predating the codes, and Details qualify it
+	Error   string
+	Code    uint32
+	Details Metadata
+	// Metadata carries key/value pairs alongside the call
+	Metadata Metadata
+	// Timeout denotes the time left before the client's deadline,
+	// 0 means the call has no deadline
+	Timeout time.Duration
+	// Kind denotes what the message is used for
+	Kind Kind
 }
 
+// Kind denotes the kind of a message
+type Kind uint8
+
+const (
+	// KindCall denotes a request or the response to it
+	KindCall Kind = iota
+	// KindCancel asks the server to abort the request of the same Seq
+	KindCancel
+	// KindGoAway tells the client to stop sending new requests,
+	// the server is shutting down
+	KindGoAway
+	// KindStream denotes a message of a stream, sent by either side
+	KindStream
+	// KindStreamEnd ends the stream of the same Seq, sent by the client
+	// it closes the sending side, sent by the server it ends the whole
+	// stream with Error set if the method failed
+	KindStreamEnd
+)
+
+// Metadata denotes key/value pairs such as trace id or auth token
+type Metadata map[string]string
+
 // Codec is an interface used to encode and decode message body
 type Codec interface {
 	io.Closer
@@ -23,14 +61,74 @@ type NewCodecFunc func(io.ReadWriteCloser) Codec
 type Type string
 
 const (
-	GobType  Type = "application/gob"
-	JsonType Type = "application/json"
+	GobType      Type = "application/gob"
+	JsonType     Type = "application/json"
+	ProtobufType Type = "application/protobuf"
+	MsgpackType  Type = "application/msgpack"
+	CborType     Type = "application/cbor"
 )
 
+// NewCodecFuncMap holds the built-in codecs, Lookup falls back to it for
+// the types not registered, so the codecs added before serving still work.
+//
+// Deprecated: writing to the map is not safe once the server or the
+// client runs, use Register instead
 var NewCodecFuncMap map[Type]NewCodecFunc
 
+var (
+	codecsMu sync.RWMutex
+	codecs   = make(map[Type]NewCodecFunc)
+)
+
+// Register makes the codec created by f available under typ, it is
+// safe for concurrent use. Registering a type twice replaces the codec
+func Register(typ Type, f NewCodecFunc) {
+	if f == nil {
+		panic("rpc codec: Register codec is nil")
+	}
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+	codecs[typ] = f
+}
+
+// Lookup returns the codec registered under typ, then the one in
+// NewCodecFuncMap, or nil
+func Lookup(typ Type) NewCodecFunc {
+	codecsMu.RLock()
+	f := codecs[typ]
+	codecsMu.RUnlock()
+	if f == nil {
+		f = NewCodecFuncMap[typ]
+	}
+	return f
+}
+
+// Types returns the registered codec types in order
+func Types() []Type {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+	types := make([]Type, 0, len(codecs))
+	for typ := range codecs {
+		types = append(types, typ)
+	}
+	for typ, f := range NewCodecFuncMap {
+		if _, ok := codecs[typ]; !ok && f != nil {
+			types = append(types, typ)
+		}
+	}
+	sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+	return types
+}
+
 func init() {
-	NewCodecFuncMap = make(map[Type]NewCodecFunc)
-	NewCodecFuncMap[GobType] = NewGobCodec
-	NewCodecFuncMap[JsonType] = NewJsonCodec
+	NewCodecFuncMap = map[Type]NewCodecFunc{
+		GobType:      NewGobCodec,
+		JsonType:     NewJsonCodec,
+		ProtobufType: NewProtobufCodec,
+		MsgpackType:  NewMsgpackCodec,
+		CborType:     NewCborCodec,
+	}
+	for typ, f := range NewCodecFuncMap {
+		Register(typ, f)
+	}
 }
@@ -0,0 +1,136 @@
+package codec
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+func _assert(condition bool, msg string, v ...any) {
+	if !condition {
+		s := fmt.Sprintf("assertion failed: "+msg, v...)
+		panic(any(s))
+	}
+}
+
+type roundTrip struct {
+	Name   string
+	Values []int
+	Tags   map[string]string
+}
+
+// selfDescribing lists the codecs encoding any Go value
+var selfDescribing = []struct {
+	typ Type
+	f   NewCodecFunc
+}{
+	{GobType, NewGobCodec},
+	{JsonType, NewJsonCodec},
+	{MsgpackType, NewMsgpackCodec},
+	{CborType, NewCborCodec},
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	for _, c := range selfDescribing {
+		for _, framed := range []bool{false, true} {
+			name := string(c.typ)
+			if framed {
+				name += " framed"
+			}
+			t.Run(name, func(t *testing.T) {
+				var conn io.ReadWriteCloser = &bufConn{}
+				if framed {
+					conn = NewFrameConn(conn)
+				}
+				cc := c.f(conn)
+				h := &Header{ServiceMethod: "Foo.Sum", Seq: 1, Metadata: Metadata{"k": "v"}, Timeout: time.Second, Kind: KindStream}
+				body := &roundTrip{Name: "rpcie", Values: []int{1, 2, 3}, Tags: map[string]string{"a": "b"}}
+				_assert(cc.Write(h, body) == nil, "write failed")
+				_assert(cc.Write(&Header{Seq: 2, Error: "failed"}, struct{}{}) == nil, "write failed")
+				_assert(cc.Write(&Header{Seq: 3}, body) == nil, "write failed")
+
+				var got Header
+				var gotBody roundTrip
+				_assert(cc.ReadHeader(&got) == nil && cc.ReadBody(&gotBody) == nil, "read failed")
+				_assert(got.ServiceMethod == h.ServiceMethod && got.Seq == h.Seq && got.Metadata["k"] == "v" &&
+					got.Timeout == h.Timeout && got.Kind == h.Kind, "wrong header %+v", got)
+				_assert(gotBody.Name == body.Name && len(gotBody.Values) == 3 && gotBody.Values[2] == 3 &&
+					gotBody.Tags["a"] == "b", "wrong body %+v", gotBody)
+
+				got = Header{}
+				_assert(cc.ReadHeader(&got) == nil && cc.ReadBody(nil) == nil, "read failed")
+				_assert(got.Seq == 2 && got.Error == "failed", "wrong header %+v", got)
+
+				got, gotBody = Header{}, roundTrip{}
+				_assert(cc.ReadHeader(&got) == nil && cc.ReadBody(&gotBody) == nil, "read failed")
+				_assert(got.Seq == 3 && gotBody.Name == body.Name, "wrong message after a skipped body")
+			})
+		}
+	}
+}
+
+func BenchmarkCodec(b *testing.B) {
+	h := &Header{ServiceMethod: "Foo.Sum", Metadata: Metadata{"trace": "t1"}}
+	body := &roundTrip{Name: "rpcie", Values: []int{1, 2, 3, 4, 5, 6, 7, 8}, Tags: map[string]string{"a": "b"}}
+	for _, c := range selfDescribing {
+		b.Run(string(c.typ), func(b *testing.B) {
+			conn := &bufConn{}
+			cc := c.f(conn)
+			var size int
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				h.Seq = uint64(i)
+				if err := cc.Write(h, body); err != nil {
+					b.Fatal(err)
+				}
+				size += conn.Len()
+				var got Header
+				var gotBody roundTrip
+				if err := cc.ReadHeader(&got); err != nil {
+					b.Fatal(err)
+				}
+				if err := cc.ReadBody(&gotBody); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(size)/float64(b.N), "bytes/msg")
+		})
+	}
+}
+
+func TestRegister(t *testing.T) {
+	const typ Type = "application/x-test"
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			Register(typ, NewJsonCodec)
+		}()
+		go func() {
+			defer wg.Done()
+			_ = Lookup(typ)
+			_ = Types()
+		}()
+	}
+	wg.Wait()
+	_assert(Lookup(typ) != nil, "expect the codec registered")
+	_assert(Lookup("application/unknown") == nil, "expect no codec for an unknown type")
+	types := Types()
+	_assert(sort.SliceIsSorted(types, func(i, j int) bool { return types[i] < types[j] }), "expect the types sorted")
+}
+
+func TestNewCodecFuncMap(t *testing.T) {
+	const typ Type = "application/x-legacy"
+	NewCodecFuncMap[typ] = NewGobCodec
+	defer delete(NewCodecFuncMap, typ)
+	_assert(Lookup(typ) != nil, "expect the codec of NewCodecFuncMap found")
+	found := false
+	for _, v := range Types() {
+		found = found || v == typ
+	}
+	_assert(found, "expect the type of NewCodecFuncMap listed")
+}
@@ -0,0 +1,358 @@
+// Package codectest checks that a codec.Codec behaves as the client and
+// the server expect, so that a new codec doesn't have to reinvent tests
+// for headers, bodies, discarded bodies and broken input
+package codectest
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/i0Ek3/rpcie/codec"
+)
+
+// Suite denotes the conformance battery for the codecs created by NewCodec
+type Suite struct {
+	NewCodec codec.NewCodecFunc
+	// Bodies are written and read back one by one, a pointer is read
+	// back into a new value of the type it points to. They default to
+	// plain Go values, a codec encoding only its own kind of values,
+	// such as protobuf, must give its own
+	Bodies []any
+	// Equal reports whether a body read back equals the one written,
+	// it defaults to reflect.DeepEqual
+	Equal func(want, got any) bool
+}
+
+// Point is one of the default bodies
+type Point struct {
+	Name   string
+	Coords []int
+	Tags   map[string]string
+	Next   *Point
+}
+
+var defaultBodies = []any{
+	42,
+	"rpcie",
+	[]int{1, 2, 3},
+	map[string]int{"a": 1, "b": 2},
+	&Point{Name: "p1", Coords: []int{1, 2}, Tags: map[string]string{"k": "v"}, Next: &Point{Name: "p2", Coords: []int{3}}},
+	[]Point{{Name: "p1", Coords: []int{1}}, {Name: "p2", Coords: []int{2}}},
+}
+
+// timeout bounds every step, a codec hanging on input fails the test
+const timeout = 5 * time.Second
+
+// Run runs the battery over a net.Pipe, on the plain connection
+// and on the framed wire format
+func Run(t *testing.T, f codec.NewCodecFunc) {
+	Suite{NewCodec: f}.Run(t)
+}
+
+func (s Suite) Run(t *testing.T) {
+	if s.Bodies == nil {
+		s.Bodies = defaultBodies
+	}
+	if s.Equal == nil {
+		s.Equal = reflect.DeepEqual
+	}
+	for _, framed := range []bool{false, true} {
+		name := "stream"
+		if framed {
+			name = "framed"
+		}
+		t.Run(name, func(t *testing.T) {
+			t.Run("header", func(t *testing.T) { s.testHeader(t, framed) })
+			t.Run("bodies", func(t *testing.T) { s.testBodies(t, framed) })
+			t.Run("discarded body", func(t *testing.T) { s.testDiscardedBody(t, framed) })
+			t.Run("concurrent writes", func(t *testing.T) { s.testConcurrentWrites(t, framed) })
+			t.Run("malformed input", func(t *testing.T) { s.testMalformedInput(t, framed) })
+			t.Run("closed connection", func(t *testing.T) { s.testClosedConnection(t, framed) })
+		})
+	}
+}
+
+// pipe returns the codecs of both ends of a pipe
+func (s Suite) pipe(t *testing.T, framed bool) (w, r codec.Codec) {
+	c1, c2 := net.Pipe()
+	t.Cleanup(func() {
+		_ = c1.Close()
+		_ = c2.Close()
+	})
+	if framed {
+		return s.NewCodec(codec.NewFrameConn(c1)), s.NewCodec(codec.NewFrameConn(c2))
+	}
+	return s.NewCodec(c1), s.NewCodec(c2)
+}
+
+// write writes the messages in the background as net.Pipe is
+// synchronous, the returned channel gets the first error
+func write(w codec.Codec, msgs ...message) <-chan error {
+	errc := make(chan error, 1)
+	go func() {
+		for _, m := range msgs {
+			if err := w.Write(m.h, m.body); err != nil {
+				errc <- err
+				return
+			}
+		}
+		errc <- nil
+	}()
+	return errc
+}
+
+type message struct {
+	h    *codec.Header
+	body any
+}
+
+// within fails t if fn doesn't return in time
+func within(t *testing.T, what string, fn func() error) error {
+	t.Helper()
+	errc := make(chan error, 1)
+	go func() { errc <- fn() }()
+	select {
+	case err := <-errc:
+		return err
+	case <-time.After(timeout):
+		t.Fatalf("%s: no return within %s", what, timeout)
+		return nil
+	}
+}
+
+func (s Suite) testHeader(t *testing.T, framed bool) {
+	w, r := s.pipe(t, framed)
+	headers := []*codec.Header{
+		{ServiceMethod: "Foo.Sum", Seq: 1},
+		{
+			ServiceMethod: "Foo.Sum",
+			Seq:           1<<64 - 1,
+			Error:         "rpc server: something failed",
+			Code:          3,
+			Details:       codec.Metadata{"field": "name"},
+			Metadata:      codec.Metadata{"trace": "t1", "user": "u1"},
+			Timeout:       1500 * time.Millisecond,
+			Kind:          codec.KindStreamEnd,
+		},
+		{Kind: codec.KindGoAway},
+	}
+	var msgs []message
+	for _, h := range headers {
+		msgs = append(msgs, message{h, struct{}{}})
+	}
+	errc := write(w, msgs...)
+	for _, want := range headers {
+		var got codec.Header
+		err := within(t, "ReadHeader", func() error { return r.ReadHeader(&got) })
+		if err != nil {
+			t.Fatalf("ReadHeader: %v", err)
+		}
+		if !headerEqual(want, &got) {
+			t.Errorf("header %+v, got %+v", *want, got)
+		}
+		if err := within(t, "ReadBody", func() error { return r.ReadBody(nil) }); err != nil {
+			t.Fatalf("ReadBody(nil): %v", err)
+		}
+	}
+	if err := <-errc; err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+}
+
+// headerEqual compares headers, a nil and an empty map are equal
+func headerEqual(a, b *codec.Header) bool {
+	return a.ServiceMethod == b.ServiceMethod && a.Seq == b.Seq && a.Error == b.Error &&
+		a.Code == b.Code && mapEqual(a.Details, b.Details) && mapEqual(a.Metadata, b.Metadata) &&
+		a.Timeout == b.Timeout && a.Kind == b.Kind
+}
+
+func mapEqual(a, b codec.Metadata) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if b[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+func (s Suite) testBodies(t *testing.T, framed bool) {
+	w, r := s.pipe(t, framed)
+	var msgs []message
+	for i, body := range s.Bodies {
+		msgs = append(msgs, message{&codec.Header{ServiceMethod: "Foo.Echo", Seq: uint64(i)}, body})
+	}
+	errc := write(w, msgs...)
+	for i, want := range s.Bodies {
+		var h codec.Header
+		if err := within(t, "ReadHeader", func() error { return r.ReadHeader(&h) }); err != nil {
+			t.Fatalf("ReadHeader: %v", err)
+		}
+		got, err := readBody(t, r, want)
+		if err != nil {
+			t.Fatalf("ReadBody of %T: %v", want, err)
+		}
+		if h.Seq != uint64(i) || !s.Equal(want, got) {
+			t.Errorf("body %d %#v, got %d %#v", i, want, h.Seq, got)
+		}
+	}
+	if err := <-errc; err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+}
+
+// readBody reads a body of the type of want and returns it in the same
+// shape, the pointer itself for a pointer or the value pointed to
+func readBody(t *testing.T, r codec.Codec, want any) (any, error) {
+	typ := reflect.TypeOf(want)
+	isPtr := typ.Kind() == reflect.Ptr
+	if isPtr {
+		typ = typ.Elem()
+	}
+	v := reflect.New(typ)
+	if err := within(t, "ReadBody", func() error { return r.ReadBody(v.Interface()) }); err != nil {
+		return nil, err
+	}
+	if isPtr {
+		return v.Interface(), nil
+	}
+	return v.Elem().Interface(), nil
+}
+
+// testDiscardedBody checks ReadBody(nil), which the client and the
+// server use to skip a body, keeps the stream in sync
+func (s Suite) testDiscardedBody(t *testing.T, framed bool) {
+	w, r := s.pipe(t, framed)
+	body := s.Bodies[len(s.Bodies)-1]
+	errc := write(w,
+		message{&codec.Header{Seq: 1}, body},
+		message{&codec.Header{Seq: 2, Error: "failed"}, struct{}{}},
+		message{&codec.Header{Seq: 3}, body},
+	)
+	for seq := uint64(1); seq <= 2; seq++ {
+		var h codec.Header
+		if err := within(t, "ReadHeader", func() error { return r.ReadHeader(&h) }); err != nil || h.Seq != seq {
+			t.Fatalf("ReadHeader: seq %d, %v", h.Seq, err)
+		}
+		if err := within(t, "ReadBody", func() error { return r.ReadBody(nil) }); err != nil {
+			t.Fatalf("ReadBody(nil): %v", err)
+		}
+	}
+	var h codec.Header
+	if err := within(t, "ReadHeader", func() error { return r.ReadHeader(&h) }); err != nil || h.Seq != 3 {
+		t.Fatalf("ReadHeader after discarded bodies: seq %d, %v", h.Seq, err)
+	}
+	got, err := readBody(t, r, body)
+	if err != nil || !s.Equal(body, got) {
+		t.Fatalf("ReadBody after discarded bodies: %#v, %v", got, err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+}
+
+// testConcurrentWrites writes from many goroutines serialized by a lock,
+// as the client and the server do, while the other end reads
+func (s Suite) testConcurrentWrites(t *testing.T, framed bool) {
+	const writers, perWriter = 8, 20
+	w, r := s.pipe(t, framed)
+	var (
+		mu   sync.Mutex
+		wg   sync.WaitGroup
+		errc = make(chan error, writers)
+	)
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < perWriter; j++ {
+				seq := uint64(i*perWriter + j)
+				body := s.Bodies[int(seq)%len(s.Bodies)]
+				mu.Lock()
+				err := w.Write(&codec.Header{ServiceMethod: fmt.Sprintf("W%d.M%d", i, j), Seq: seq}, body)
+				mu.Unlock()
+				if err != nil {
+					errc <- err
+					return
+				}
+			}
+		}(i)
+	}
+	seen := make(map[uint64]bool)
+	for n := 0; n < writers*perWriter; n++ {
+		var h codec.Header
+		if err := within(t, "ReadHeader", func() error { return r.ReadHeader(&h) }); err != nil {
+			t.Fatalf("ReadHeader: %v", err)
+		}
+		want := s.Bodies[int(h.Seq)%len(s.Bodies)]
+		got, err := readBody(t, r, want)
+		if err != nil {
+			t.Fatalf("ReadBody: %v", err)
+		}
+		method := fmt.Sprintf("W%d.M%d", h.Seq/perWriter, h.Seq%perWriter)
+		if seen[h.Seq] || h.ServiceMethod != method || !s.Equal(want, got) {
+			t.Fatalf("message %d mixed up: %+v %#v", h.Seq, h, got)
+		}
+		seen[h.Seq] = true
+	}
+	wg.Wait()
+	close(errc)
+	if err := <-errc; err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+}
+
+// testMalformedInput checks garbage makes the reads fail without
+// hanging or panicking
+func (s Suite) testMalformedInput(t *testing.T, framed bool) {
+	c1, c2 := net.Pipe()
+	defer func() { _ = c2.Close() }()
+	var conn io.ReadWriteCloser = c2
+	if framed {
+		conn = codec.NewFrameConn(c2)
+	}
+	r := s.NewCodec(conn)
+	go func() {
+		garbage := make([]byte, 64)
+		for i := range garbage {
+			garbage[i] = 0xff
+		}
+		_, _ = c1.Write(garbage)
+		_ = c1.Close()
+	}()
+	err := within(t, "ReadHeader", func() (err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				err = fmt.Errorf("panic: %v", r)
+				t.Error(err)
+			}
+		}()
+		var h codec.Header
+		if err := r.ReadHeader(&h); err != nil {
+			return err
+		}
+		return r.ReadBody(nil)
+	})
+	if err == nil {
+		t.Fatal("expect an error reading garbage")
+	}
+}
+
+func (s Suite) testClosedConnection(t *testing.T, framed bool) {
+	w, r := s.pipe(t, framed)
+	_ = w.Close()
+	var h codec.Header
+	if err := within(t, "ReadHeader", func() error { return r.ReadHeader(&h) }); err == nil {
+		t.Fatal("expect an error reading a closed connection")
+	}
+	if err := within(t, "Write", func() error { return w.Write(&codec.Header{}, struct{}{}) }); err == nil {
+		t.Fatal("expect an error writing a closed connection")
+	}
+}
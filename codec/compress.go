@@ -0,0 +1,121 @@
+package codec
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Compression denotes the algorithm compressing the bodies of the frames
+type Compression string
+
+const (
+	CompressionGzip  Compression = "gzip"
+	CompressionFlate Compression = "flate"
+)
+
+// FlagCompressed is set in the flags of a frame whose body is compressed
+const FlagCompressed uint8 = 1 << 0
+
+// DefaultCompressThreshold denotes the size in bytes from which
+// the bodies are compressed when no threshold is given
+const DefaultCompressThreshold = 1 << 10
+
+// compressor pools its writers and readers, creating them is
+// far more expensive than compressing a message
+type compressor struct {
+	newWriter   func(w io.Writer) (resetWriter, error)
+	newReader   func(r io.Reader) (io.ReadCloser, error)
+	resetReader func(zr io.ReadCloser, r io.Reader) error
+	writers     sync.Pool
+	readers     sync.Pool
+}
+
+type resetWriter interface {
+	io.WriteCloser
+	Reset(w io.Writer)
+}
+
+var compressors = map[Compression]*compressor{
+	CompressionGzip: {
+		newWriter:   func(w io.Writer) (resetWriter, error) { return gzip.NewWriter(w), nil },
+		newReader:   func(r io.Reader) (io.ReadCloser, error) { return gzip.NewReader(r) },
+		resetReader: func(zr io.ReadCloser, r io.Reader) error { return zr.(*gzip.Reader).Reset(r) },
+	},
+	CompressionFlate: {
+		newWriter:   func(w io.Writer) (resetWriter, error) { return flate.NewWriter(w, flate.DefaultCompression) },
+		newReader:   func(r io.Reader) (io.ReadCloser, error) { return flate.NewReader(r), nil },
+		resetReader: func(zr io.ReadCloser, r io.Reader) error { return zr.(flate.Resetter).Reset(r, nil) },
+	},
+}
+
+// Compress makes conn compress the bodies of at least threshold bytes
+// with alg, 0 means DefaultCompressThreshold. The frames flag the
+// compressed bodies, so conn must be a *FrameConn, and both peers must
+// use the same alg. An empty alg leaves conn as it is
+func Compress(conn io.ReadWriteCloser, alg Compression, threshold int) (io.ReadWriteCloser, error) {
+	if alg == "" {
+		return conn, nil
+	}
+	cp, ok := compressors[alg]
+	if !ok {
+		return nil, fmt.Errorf("rpc codec: unsupported compression %q", alg)
+	}
+	fc, ok := conn.(*FrameConn)
+	if !ok {
+		return nil, errors.New("rpc codec: compression requires the framed wire format")
+	}
+	if threshold <= 0 {
+		threshold = DefaultCompressThreshold
+	}
+	fc.compressor, fc.threshold = cp, threshold
+	return fc, nil
+}
+
+// compress writes b compressed to dst
+func (cp *compressor) compress(dst *bytes.Buffer, b []byte) error {
+	zw, _ := cp.writers.Get().(resetWriter)
+	if zw == nil {
+		var err error
+		if zw, err = cp.newWriter(dst); err != nil {
+			return err
+		}
+	} else {
+		zw.Reset(dst)
+	}
+	defer cp.writers.Put(zw)
+	if _, err := zw.Write(b); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// decompress reads the compressed body from r to dst, it reports
+// false without reading the rest if it decompresses to more than
+// limit bytes, 0 means no limit
+func (cp *compressor) decompress(dst *bytes.Buffer, r io.Reader, limit int) (bool, error) {
+	zr, _ := cp.readers.Get().(io.ReadCloser)
+	var err error
+	if zr == nil {
+		zr, err = cp.newReader(r)
+	} else {
+		err = cp.resetReader(zr, r)
+	}
+	if err != nil {
+		return false, err
+	}
+	defer cp.readers.Put(zr)
+	var src io.Reader = zr
+	if limit > 0 {
+		src = io.LimitReader(zr, int64(limit)+1)
+	}
+	n, err := dst.ReadFrom(src)
+	if err != nil {
+		return false, err
+	}
+	return limit <= 0 || n <= int64(limit), nil
+}
@@ -0,0 +1,42 @@
+package codec
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCompress(t *testing.T) {
+	for _, alg := range []Compression{CompressionGzip, CompressionFlate} {
+		t.Run(string(alg), func(t *testing.T) {
+			conn := &bufConn{}
+			rwc, err := Compress(NewFrameConn(conn), alg, 64)
+			_assert(err == nil, "failed to set compression: %v", err)
+			cc := NewJsonCodec(rwc)
+			large := strings.Repeat("rpcie ", 1000)
+
+			_assert(cc.Write(&Header{Seq: 1}, "small") == nil, "write failed")
+			_assert(conn.Bytes()[3]&FlagCompressed == 0, "expect a small body sent as is")
+			var got string
+			_assert(cc.ReadHeader(&Header{}) == nil && cc.ReadBody(&got) == nil && got == "small", "read failed")
+
+			_assert(cc.Write(&Header{Seq: 2}, large) == nil, "write failed")
+			_assert(conn.Bytes()[3]&FlagCompressed != 0, "expect a large body compressed")
+			_assert(conn.Len() < len(large)/10, "expect the frame compressed, got %d bytes", conn.Len())
+			_assert(cc.ReadHeader(&Header{}) == nil && cc.ReadBody(&got) == nil && got == large, "read failed")
+
+			// the limit applies to the decompressed body
+			_assert(cc.Write(&Header{Seq: 3}, large) == nil, "write failed")
+			_assert(cc.Write(&Header{Seq: 4}, "small") == nil, "write failed")
+			Limit(rwc, 0, 1024)
+			var h Header
+			_assert(cc.ReadHeader(&h) == nil && h.Seq == 3, "read failed")
+			_assert(cc.ReadBody(&got) == ErrBodyTooLarge, "expect ErrBodyTooLarge")
+			_assert(cc.ReadHeader(&h) == nil && h.Seq == 4 && cc.ReadBody(&got) == nil && got == "small", "expect the stream to go on")
+		})
+	}
+
+	_, err := Compress(&bufConn{}, CompressionGzip, 0)
+	_assert(err != nil, "expect compression to require framing")
+	_, err = Compress(NewFrameConn(&bufConn{}), "lz4", 0)
+	_assert(err != nil, "expect an unsupported compression rejected")
+}
@@ -0,0 +1,32 @@
+package codec_test
+
+import (
+	"testing"
+
+	"github.com/i0Ek3/rpcie/codec"
+	"github.com/i0Ek3/rpcie/codec/codectest"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+func TestConformance(t *testing.T) {
+	for _, typ := range []codec.Type{codec.GobType, codec.JsonType, codec.MsgpackType, codec.CborType} {
+		t.Run(string(typ), func(t *testing.T) {
+			codectest.Run(t, codec.Lookup(typ))
+		})
+	}
+	t.Run(string(codec.ProtobufType), func(t *testing.T) {
+		list, _ := structpb.NewList([]any{1, "two", true})
+		codectest.Suite{
+			NewCodec: codec.NewProtobufCodec,
+			Bodies: []any{
+				wrapperspb.Int64(42),
+				wrapperspb.String("rpcie"),
+				list,
+				&structpb.Struct{Fields: map[string]*structpb.Value{"a": structpb.NewNumberValue(1)}},
+			},
+			Equal: func(want, got any) bool { return proto.Equal(want.(proto.Message), got.(proto.Message)) },
+		}.Run(t)
+	})
+}
@@ -0,0 +1,281 @@
+package codec
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// The framed wire format puts every message in a frame:
+//
+//	| magic 2 | version 1 | flags 1 | header length 4 | body length 4 | header | body |
+//
+// integers are big endian, flags carry FlagCompressed. A reader can
+// skip a frame it does not understand or bound its size before reading it
+const (
+	FrameMagic   uint16 = 0x3bef
+	FrameVersion uint8  = 1
+
+	frameHeadSize = 12
+	// maxReusedFrame bounds the buffer kept by a connection to write frames
+	maxReusedFrame = 64 << 10
+)
+
+var ErrBadFrame = errors.New("rpc codec: bad frame")
+
+// Framer is implemented by connections which frame messages. A codec
+// calls BeginMessage before encoding a message, EndHeader once the
+// header bytes are written and EndMessage after the body. Without
+// these calls every write is sent as a frame of its own
+type Framer interface {
+	BeginMessage()
+	EndHeader()
+	EndMessage() error
+}
+
+// FrameConn implements the framed wire format on top of conn,
+// the codecs read and write through it as through conn
+type FrameConn struct {
+	conn io.ReadWriteCloser
+	r    *bufio.Reader
+	// cur reads the frame being read, of which left bytes are left.
+	// The body of an oversized frame is not read, skip bytes of it
+	// are still to be discarded from r
+	cur       io.Reader
+	left      int
+	skip      int64
+	oversized bool
+	head      [frameHeadSize]byte
+	err       error
+
+	// maxHeader and maxBody are set by Limit
+	maxHeader, maxBody int
+	// compressor and threshold are set by Compress
+	compressor *compressor
+	threshold  int
+	// rbuf holds the frame being read if it is compressed,
+	// zbuf the compressed body being written
+	rbuf bytes.Buffer
+	zbuf bytes.Buffer
+
+	// wbuf holds the message being written, frame the frame sent
+	wbuf      bytes.Buffer
+	frame     []byte
+	inMessage bool
+	headerLen int
+}
+
+var (
+	_ Framer  = (*FrameConn)(nil)
+	_ Limiter = (*FrameConn)(nil)
+)
+
+func NewFrameConn(conn io.ReadWriteCloser) *FrameConn {
+	return &FrameConn{
+		conn: conn,
+		r:    bufio.NewReader(conn),
+	}
+}
+
+// Read reads the header and body bytes of the frames in order
+func (c *FrameConn) Read(p []byte) (int, error) {
+	for c.left == 0 {
+		if c.err != nil {
+			return 0, c.err
+		}
+		if c.oversized {
+			// the body of the frame has to be read but it was not
+			// asked for by BeginBody, the stream is out of sync
+			c.err = ErrBodyTooLarge
+			return 0, c.err
+		}
+		if err := c.next(); err != nil {
+			return 0, err
+		}
+	}
+	if len(p) > c.left {
+		p = p[:c.left]
+	}
+	n, err := c.cur.Read(p)
+	c.left -= n
+	return n, err
+}
+
+// next reads the head of the next frame, frames of other versions are
+// skipped. An oversized header fails the stream, the body of an
+// oversized one is left to BeginBody
+func (c *FrameConn) next() error {
+	if _, err := io.ReadFull(c.r, c.head[:]); err != nil {
+		return err
+	}
+	if binary.BigEndian.Uint16(c.head[0:2]) != FrameMagic {
+		c.err = ErrBadFrame
+		return c.err
+	}
+	hlen := int64(binary.BigEndian.Uint32(c.head[4:8]))
+	blen := int64(binary.BigEndian.Uint32(c.head[8:12]))
+	if c.head[2] != FrameVersion {
+		if _, err := io.CopyN(io.Discard, c.r, hlen+blen); err != nil {
+			return fmt.Errorf("rpc codec: skip frame of version %d: %w", c.head[2], err)
+		}
+		return nil
+	}
+	if c.maxHeader > 0 && hlen > int64(c.maxHeader) {
+		c.err = ErrHeaderTooLarge
+		return c.err
+	}
+	if c.maxBody > 0 && blen > int64(c.maxBody) {
+		c.cur, c.left, c.skip, c.oversized = c.r, int(hlen), blen, true
+		return nil
+	}
+	if c.head[3]&FlagCompressed != 0 {
+		return c.nextCompressed(hlen, blen)
+	}
+	c.cur, c.left = c.r, int(hlen+blen)
+	return nil
+}
+
+// nextCompressed decompresses the body of the frame being read,
+// the frame is held in memory then
+func (c *FrameConn) nextCompressed(hlen, blen int64) error {
+	if c.compressor == nil {
+		c.err = errors.New("rpc codec: compressed frame without compression negotiated")
+		return c.err
+	}
+	// the previous frame was read to its end, its buffer is free
+	c.rbuf.Reset()
+	if _, err := io.CopyN(&c.rbuf, c.r, hlen); err != nil {
+		return err
+	}
+	body := io.LimitReader(c.r, blen)
+	ok, err := c.compressor.decompress(&c.rbuf, body, c.maxBody)
+	if err == nil {
+		// the compressed stream may end before the body
+		_, err = io.Copy(io.Discard, body)
+	}
+	if err != nil {
+		c.err = fmt.Errorf("rpc codec: decompress body: %w", err)
+		return c.err
+	}
+	if !ok {
+		c.rbuf.Truncate(int(hlen))
+		c.cur, c.left, c.oversized = &c.rbuf, int(hlen), true
+		return nil
+	}
+	c.cur, c.left = &c.rbuf, c.rbuf.Len()
+	return nil
+}
+
+func (c *FrameConn) BeginHeader() error {
+	return c.err
+}
+
+// BeginBody discards the body of the frame being read if it is oversized
+func (c *FrameConn) BeginBody() error {
+	if c.err != nil {
+		return c.err
+	}
+	if !c.oversized {
+		return nil
+	}
+	// the header was read up to its end, what is left is the body
+	if _, err := io.CopyN(io.Discard, c.cur, int64(c.left)); err != nil {
+		c.err = err
+		return err
+	}
+	if _, err := io.CopyN(io.Discard, c.r, c.skip); err != nil {
+		c.err = err
+		return err
+	}
+	c.left, c.skip, c.oversized = 0, 0, false
+	return ErrBodyTooLarge
+}
+
+// Write buffers p into the message being written, outside
+// of a message p is sent as the body of a frame at once
+func (c *FrameConn) Write(p []byte) (int, error) {
+	if !c.inMessage {
+		return len(p), c.writeFrame(nil, p)
+	}
+	return c.wbuf.Write(p)
+}
+
+func (c *FrameConn) BeginMessage() {
+	c.inMessage = true
+	c.headerLen = 0
+	c.wbuf.Reset()
+}
+
+func (c *FrameConn) EndHeader() {
+	c.headerLen = c.wbuf.Len()
+}
+
+// EndMessage sends the message as a frame
+func (c *FrameConn) EndMessage() error {
+	c.inMessage = false
+	b := c.wbuf.Bytes()
+	return c.writeFrame(b[:c.headerLen], b[c.headerLen:])
+}
+
+// writeFrame sends a frame, its body is compressed
+// if it is large enough and it gets smaller
+func (c *FrameConn) writeFrame(header, body []byte) error {
+	var flags uint8
+	if c.compressor != nil && len(body) >= c.threshold {
+		c.zbuf.Reset()
+		if err := c.compressor.compress(&c.zbuf, body); err != nil {
+			return err
+		}
+		if c.zbuf.Len() < len(body) {
+			body, flags = c.zbuf.Bytes(), FlagCompressed
+		}
+	}
+	// the frame buffer is reused unless a large message grew it
+	if cap(c.frame) < frameHeadSize || cap(c.frame) > maxReusedFrame {
+		c.frame = make([]byte, frameHeadSize, frameHeadSize+len(header)+len(body))
+	}
+	frame := c.frame[:frameHeadSize]
+	binary.BigEndian.PutUint16(frame[0:2], FrameMagic)
+	frame[2] = FrameVersion
+	frame[3] = flags
+	binary.BigEndian.PutUint32(frame[4:8], uint32(len(header)))
+	binary.BigEndian.PutUint32(frame[8:12], uint32(len(body)))
+	frame = append(append(frame, header...), body...)
+	c.frame = frame
+	_, err := c.conn.Write(frame)
+	return err
+}
+
+func (c *FrameConn) Close() error {
+	return c.conn.Close()
+}
+
+// beginMessage and the helpers below let a codec frame its
+// messages when conn is a Framer, they do nothing otherwise
+func beginMessage(conn io.ReadWriteCloser) Framer {
+	f, _ := conn.(Framer)
+	if f != nil {
+		f.BeginMessage()
+	}
+	return f
+}
+
+func endHeader(f Framer, buf *bufio.Writer) {
+	if f != nil {
+		_ = buf.Flush()
+		f.EndHeader()
+	}
+}
+
+func endMessage(f Framer, buf *bufio.Writer) error {
+	err := buf.Flush()
+	if f != nil {
+		if ferr := f.EndMessage(); err == nil {
+			err = ferr
+		}
+	}
+	return err
+}
@@ -0,0 +1,69 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"strings"
+	"testing"
+
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// bufConn is an in-memory connection reading what was written to it
+type bufConn struct {
+	bytes.Buffer
+}
+
+func (c *bufConn) Close() error { return nil }
+
+func TestFrameConn(t *testing.T) {
+	for _, typ := range Types() {
+		f := Lookup(typ)
+		t.Run(string(typ), func(t *testing.T) {
+			conn := &bufConn{}
+			cc := f(NewFrameConn(conn))
+			h := &Header{ServiceMethod: "Foo.Sum", Seq: 7, Metadata: Metadata{"k": "v"}}
+			_assert(cc.Write(h, wrapperspb.Int64(3)) == nil, "write failed")
+
+			raw := conn.Bytes()
+			_assert(binary.BigEndian.Uint16(raw) == FrameMagic, "bad magic")
+			_assert(raw[2] == FrameVersion, "bad version %d", raw[2])
+			hlen := binary.BigEndian.Uint32(raw[4:8])
+			blen := binary.BigEndian.Uint32(raw[8:12])
+			_assert(hlen > 0 && blen > 0, "empty header or body")
+			_assert(int(frameHeadSize+hlen+blen) == len(raw), "frame of %d bytes, got %d", frameHeadSize+hlen+blen, len(raw))
+
+			var got Header
+			var body wrapperspb.Int64Value
+			_assert(cc.ReadHeader(&got) == nil, "read header failed")
+			_assert(cc.ReadBody(&body) == nil, "read body failed")
+			_assert(got.ServiceMethod == h.ServiceMethod && got.Seq == h.Seq && got.Metadata["k"] == "v", "wrong header %+v", got)
+			_assert(body.Value == 3, "wrong body %d", body.Value)
+		})
+	}
+
+	t.Run("skip unknown version", func(t *testing.T) {
+		conn := &bufConn{}
+		_, _ = conn.Write([]byte{0x3b, 0xef, FrameVersion + 1, 0, 0, 0, 0, 3, 0, 0, 0, 2, 'a', 'b', 'c', 'd', 'e'})
+		fc := NewFrameConn(conn)
+		_, _ = fc.Write([]byte("known"))
+		b, err := io.ReadAll(fc)
+		_assert(err == nil && string(b) == "known", "expect the unknown frame skipped, got %q %v", b, err)
+	})
+
+	t.Run("bad magic", func(t *testing.T) {
+		conn := &bufConn{}
+		_, _ = conn.Write(make([]byte, frameHeadSize))
+		_, err := NewFrameConn(conn).Read(make([]byte, 1))
+		_assert(err == ErrBadFrame, "expect ErrBadFrame, got %v", err)
+	})
+
+	t.Run("oversized header", func(t *testing.T) {
+		conn := &bufConn{}
+		_ = NewGobCodec(NewFrameConn(conn)).Write(&Header{ServiceMethod: strings.Repeat("x", 64)}, 1)
+		cc := NewGobCodec(Limit(NewFrameConn(conn), 16, 0))
+		err := cc.ReadHeader(&Header{})
+		_assert(err == ErrHeaderTooLarge, "expect ErrHeaderTooLarge, got %v", err)
+	})
+}
@@ -12,6 +12,9 @@ type GobCodec struct {
 	buf  *bufio.Writer
 	dec  *gob.Decoder
 	enc  *gob.Encoder
+	// err fails the reads once a body was skipped, it may have
+	// carried type definitions the following messages rely on
+	err error
 }
 
 var _ Codec = (*GobCodec)(nil)
@@ -27,16 +30,29 @@ func NewGobCodec(conn io.ReadWriteCloser) Codec {
 }
 
 func (c *GobCodec) ReadHeader(h *Header) error {
+	if c.err != nil {
+		return c.err
+	}
+	if err := beginHeader(c.conn); err != nil {
+		return err
+	}
 	return c.dec.Decode(h)
 }
 
 func (c *GobCodec) ReadBody(body any) error {
+	if err := beginBody(c.conn); err != nil {
+		c.err = err
+		return err
+	}
 	return c.dec.Decode(body)
 }
 
 func (c *GobCodec) Write(h *Header, body any) (err error) {
+	f := beginMessage(c.conn)
 	defer func() {
-		_ = c.buf.Flush()
+		if ferr := endMessage(f, c.buf); err == nil {
+			err = ferr
+		}
 		if err != nil {
 			_ = c.Close()
 		}
@@ -45,6 +61,7 @@ func (c *GobCodec) Write(h *Header, body any) (err error) {
 		log.Println("rpc codec: gob error encoding header:", err)
 		return err
 	}
+	endHeader(f, c.buf)
 	if err := c.enc.Encode(body); err != nil {
 		log.Println("rpc codec: gob error encoding body:", err)
 		return err
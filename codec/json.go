@@ -27,16 +27,30 @@ func NewJsonCodec(conn io.ReadWriteCloser) Codec {
 }
 
 func (c *JsonCodec) ReadHeader(h *Header) error {
+	if err := beginHeader(c.conn); err != nil {
+		return err
+	}
 	return c.dec.Decode(h)
 }
 
 func (c *JsonCodec) ReadBody(body any) error {
+	if err := beginBody(c.conn); err != nil {
+		return err
+	}
+	if body == nil {
+		// unlike gob, json can't decode into nil to discard a value
+		var discard json.RawMessage
+		return c.dec.Decode(&discard)
+	}
 	return c.dec.Decode(body)
 }
 
 func (c *JsonCodec) Write(h *Header, body any) (err error) {
+	f := beginMessage(c.conn)
 	defer func() {
-		_ = c.buf.Flush()
+		if ferr := endMessage(f, c.buf); err == nil {
+			err = ferr
+		}
 		if err != nil {
 			_ = c.Close()
 		}
@@ -45,6 +59,7 @@ func (c *JsonCodec) Write(h *Header, body any) (err error) {
 		log.Println("rpc codec: json error encoding header:", err)
 		return err
 	}
+	endHeader(f, c.buf)
 	if err := c.enc.Encode(body); err != nil {
 		log.Println("rpc codec: json error encoding body:", err)
 		return err
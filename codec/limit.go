@@ -0,0 +1,94 @@
+package codec
+
+import (
+	"errors"
+	"io"
+)
+
+var (
+	ErrHeaderTooLarge = errors.New("rpc codec: header exceeds the size limit")
+	ErrBodyTooLarge   = errors.New("rpc codec: body exceeds the size limit")
+)
+
+// Limiter is implemented by connections which bound the size of the
+// messages read. A codec calls BeginHeader before reading a header and
+// BeginBody before reading a body, BeginBody returns ErrBodyTooLarge
+// without the body being read if it exceeds the limit
+type Limiter interface {
+	BeginHeader() error
+	BeginBody() error
+}
+
+// Limit bounds the headers and bodies read from conn to maxHeader and
+// maxBody bytes, 0 means no limit. A framed connection knows the sizes
+// before reading, so an oversized body is skipped and the stream goes
+// on. Otherwise the stream can't be resynchronized once a limit is hit
+// and every following read fails
+func Limit(conn io.ReadWriteCloser, maxHeader, maxBody int) io.ReadWriteCloser {
+	if maxHeader <= 0 && maxBody <= 0 {
+		return conn
+	}
+	if fc, ok := conn.(*FrameConn); ok {
+		fc.maxHeader, fc.maxBody = maxHeader, maxBody
+		return fc
+	}
+	return &limitConn{ReadWriteCloser: conn, maxHeader: maxHeader, maxBody: maxBody}
+}
+
+// limitConn bounds the bytes read from an unframed stream since the
+// last BeginHeader or BeginBody. The decoders may have buffered some
+// bytes of the message before, so a message can exceed the limit by
+// what was read ahead, a few kilobytes at most
+type limitConn struct {
+	io.ReadWriteCloser
+	maxHeader, maxBody int
+
+	// n bytes have been read of max allowed, exceeding it fails with exceeded
+	n, max   int
+	exceeded error
+	err      error
+}
+
+var _ Limiter = (*limitConn)(nil)
+
+func (c *limitConn) BeginHeader() error {
+	c.n, c.max, c.exceeded = 0, c.maxHeader, ErrHeaderTooLarge
+	return c.err
+}
+
+func (c *limitConn) BeginBody() error {
+	c.n, c.max, c.exceeded = 0, c.maxBody, ErrBodyTooLarge
+	return c.err
+}
+
+func (c *limitConn) Read(p []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	if c.max > 0 {
+		if c.n >= c.max {
+			c.err = c.exceeded
+			return 0, c.err
+		}
+		if len(p) > c.max-c.n {
+			p = p[:c.max-c.n]
+		}
+	}
+	n, err := c.ReadWriteCloser.Read(p)
+	c.n += n
+	return n, err
+}
+
+func beginHeader(conn io.ReadWriteCloser) error {
+	if l, ok := conn.(Limiter); ok {
+		return l.BeginHeader()
+	}
+	return nil
+}
+
+func beginBody(conn io.ReadWriteCloser) error {
+	if l, ok := conn.(Limiter); ok {
+		return l.BeginBody()
+	}
+	return nil
+}
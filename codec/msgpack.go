@@ -0,0 +1,71 @@
+package codec
+
+import (
+	"bufio"
+	"io"
+	"log"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+type MsgpackCodec struct {
+	conn io.ReadWriteCloser
+	buf  *bufio.Writer
+	dec  *msgpack.Decoder
+	enc  *msgpack.Encoder
+}
+
+var _ Codec = (*MsgpackCodec)(nil)
+
+func NewMsgpackCodec(conn io.ReadWriteCloser) Codec {
+	buf := bufio.NewWriter(conn)
+	return &MsgpackCodec{
+		conn: conn,
+		buf:  buf,
+		dec:  msgpack.NewDecoder(conn),
+		enc:  msgpack.NewEncoder(buf),
+	}
+}
+
+func (c *MsgpackCodec) ReadHeader(h *Header) error {
+	if err := beginHeader(c.conn); err != nil {
+		return err
+	}
+	return c.dec.Decode(h)
+}
+
+func (c *MsgpackCodec) ReadBody(body any) error {
+	if err := beginBody(c.conn); err != nil {
+		return err
+	}
+	if body == nil {
+		return c.dec.Skip()
+	}
+	return c.dec.Decode(body)
+}
+
+func (c *MsgpackCodec) Write(h *Header, body any) (err error) {
+	f := beginMessage(c.conn)
+	defer func() {
+		if ferr := endMessage(f, c.buf); err == nil {
+			err = ferr
+		}
+		if err != nil {
+			_ = c.Close()
+		}
+	}()
+	if err := c.enc.Encode(h); err != nil {
+		log.Println("rpc codec: msgpack error encoding header:", err)
+		return err
+	}
+	endHeader(f, c.buf)
+	if err := c.enc.Encode(body); err != nil {
+		log.Println("rpc codec: msgpack error encoding body:", err)
+		return err
+	}
+	return nil
+}
+
+func (c *MsgpackCodec) Close() error {
+	return c.conn.Close()
+}
@@ -0,0 +1,255 @@
+package codec
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+)
+
+// ProtobufCodec writes the header and the body of a message as protobuf
+// messages, each one prefixed with its length as a varint. The header
+// follows the schema in header.proto, the body must be a proto.Message.
+// Control messages and failed responses carry an empty body
+type ProtobufCodec struct {
+	conn io.ReadWriteCloser
+	r    *bufio.Reader
+	buf  *bufio.Writer
+}
+
+var _ Codec = (*ProtobufCodec)(nil)
+
+func NewProtobufCodec(conn io.ReadWriteCloser) Codec {
+	return &ProtobufCodec{
+		conn: conn,
+		r:    bufio.NewReader(conn),
+		buf:  bufio.NewWriter(conn),
+	}
+}
+
+func (c *ProtobufCodec) ReadHeader(h *Header) error {
+	if err := beginHeader(c.conn); err != nil {
+		return err
+	}
+	b, err := c.readMessage()
+	if err != nil {
+		return err
+	}
+	return unmarshalHeader(b, h)
+}
+
+func (c *ProtobufCodec) ReadBody(body any) error {
+	if err := beginBody(c.conn); err != nil {
+		return err
+	}
+	b, err := c.readMessage()
+	if err != nil || body == nil {
+		return err
+	}
+	m, ok := body.(proto.Message)
+	if !ok {
+		return fmt.Errorf("rpc codec: protobuf body must be a proto.Message, got %T", body)
+	}
+	return proto.Unmarshal(b, m)
+}
+
+// readMessage reads a length-delimited message, the buffer grows with
+// the bytes actually read so that a forged length can't allocate it
+func (c *ProtobufCodec) readMessage() ([]byte, error) {
+	n, err := binary.ReadUvarint(c.r)
+	if err != nil {
+		return nil, err
+	}
+	var b bytes.Buffer
+	if _, err := b.ReadFrom(io.LimitReader(c.r, int64(n))); err != nil {
+		return nil, err
+	}
+	if uint64(b.Len()) != n {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return b.Bytes(), nil
+}
+
+func (c *ProtobufCodec) Write(h *Header, body any) (err error) {
+	var b []byte
+	switch m := body.(type) {
+	case nil, struct{}:
+	case proto.Message:
+		if b, err = proto.Marshal(m); err != nil {
+			log.Println("rpc codec: protobuf error encoding body:", err)
+			return err
+		}
+	default:
+		// nothing is written yet, the stream is still usable
+		err = fmt.Errorf("rpc codec: protobuf body must be a proto.Message, got %T", body)
+		log.Println("rpc codec: protobuf error encoding body:", err)
+		return err
+	}
+
+	f := beginMessage(c.conn)
+	defer func() {
+		if ferr := endMessage(f, c.buf); err == nil {
+			err = ferr
+		}
+		if err != nil {
+			_ = c.Close()
+		}
+	}()
+	if _, err := c.buf.Write(protowire.AppendBytes(nil, marshalHeader(nil, h))); err != nil {
+		log.Println("rpc codec: protobuf error encoding header:", err)
+		return err
+	}
+	endHeader(f, c.buf)
+	if _, err := c.buf.Write(protowire.AppendBytes(nil, b)); err != nil {
+		log.Println("rpc codec: protobuf error encoding body:", err)
+		return err
+	}
+	return nil
+}
+
+func (c *ProtobufCodec) Close() error {
+	return c.conn.Close()
+}
+
+// the field numbers of Header in header.proto
+const (
+	headerServiceMethod protowire.Number = iota + 1
+	headerSeq
+	headerError
+	headerMetadata
+	headerTimeout
+	headerKind
+	headerCode
+	headerDetails
+)
+
+func marshalHeader(b []byte, h *Header) []byte {
+	if h.ServiceMethod != "" {
+		b = protowire.AppendTag(b, headerServiceMethod, protowire.BytesType)
+		b = protowire.AppendString(b, h.ServiceMethod)
+	}
+	if h.Seq != 0 {
+		b = protowire.AppendTag(b, headerSeq, protowire.VarintType)
+		b = protowire.AppendVarint(b, h.Seq)
+	}
+	if h.Error != "" {
+		b = protowire.AppendTag(b, headerError, protowire.BytesType)
+		b = protowire.AppendString(b, h.Error)
+	}
+	b = appendMap(b, headerMetadata, h.Metadata)
+	if h.Timeout != 0 {
+		b = protowire.AppendTag(b, headerTimeout, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(h.Timeout))
+	}
+	if h.Kind != KindCall {
+		b = protowire.AppendTag(b, headerKind, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(h.Kind))
+	}
+	if h.Code != 0 {
+		b = protowire.AppendTag(b, headerCode, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(h.Code))
+	}
+	return appendMap(b, headerDetails, h.Details)
+}
+
+// appendMap appends m as the entries of the map field num
+func appendMap(b []byte, num protowire.Number, m Metadata) []byte {
+	for k, v := range m {
+		var entry []byte
+		entry = protowire.AppendTag(entry, 1, protowire.BytesType)
+		entry = protowire.AppendString(entry, k)
+		entry = protowire.AppendTag(entry, 2, protowire.BytesType)
+		entry = protowire.AppendString(entry, v)
+		b = protowire.AppendTag(b, num, protowire.BytesType)
+		b = protowire.AppendBytes(b, entry)
+	}
+	return b
+}
+
+func unmarshalHeader(b []byte, h *Header) error {
+	*h = Header{}
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		switch {
+		case num == headerServiceMethod && typ == protowire.BytesType:
+			h.ServiceMethod, n = protowire.ConsumeString(b)
+		case num == headerSeq && typ == protowire.VarintType:
+			h.Seq, n = protowire.ConsumeVarint(b)
+		case num == headerError && typ == protowire.BytesType:
+			h.Error, n = protowire.ConsumeString(b)
+		case num == headerMetadata && typ == protowire.BytesType:
+			var entry []byte
+			if entry, n = protowire.ConsumeBytes(b); n >= 0 {
+				if err := unmarshalMapEntry(entry, &h.Metadata); err != nil {
+					return err
+				}
+			}
+		case num == headerTimeout && typ == protowire.VarintType:
+			var v uint64
+			v, n = protowire.ConsumeVarint(b)
+			h.Timeout = time.Duration(v)
+		case num == headerKind && typ == protowire.VarintType:
+			var v uint64
+			v, n = protowire.ConsumeVarint(b)
+			h.Kind = Kind(v)
+		case num == headerCode && typ == protowire.VarintType:
+			var v uint64
+			v, n = protowire.ConsumeVarint(b)
+			h.Code = uint32(v)
+		case num == headerDetails && typ == protowire.BytesType:
+			var entry []byte
+			if entry, n = protowire.ConsumeBytes(b); n >= 0 {
+				if err := unmarshalMapEntry(entry, &h.Details); err != nil {
+					return err
+				}
+			}
+		default:
+			// unknown fields are skipped for forward compatibility
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+	}
+	return nil
+}
+
+// unmarshalMapEntry adds the entry of a map field to *m
+func unmarshalMapEntry(b []byte, m *Metadata) error {
+	var k, v string
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		switch {
+		case num == 1 && typ == protowire.BytesType:
+			k, n = protowire.ConsumeString(b)
+		case num == 2 && typ == protowire.BytesType:
+			v, n = protowire.ConsumeString(b)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+	}
+	if *m == nil {
+		*m = make(Metadata)
+	}
+	(*m)[k] = v
+	return nil
+}
@@ -0,0 +1,39 @@
+package codec
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+func TestProtobufCodec(t *testing.T) {
+	conn := &bufConn{}
+	cc := NewProtobufCodec(conn)
+	h := &Header{
+		ServiceMethod: "Foo.Echo",
+		Seq:           42,
+		Metadata:      Metadata{"trace": "t1", "user": "u1"},
+		Timeout:       time.Second,
+		Kind:          KindStream,
+	}
+	_assert(cc.Write(h, wrapperspb.String("hello")) == nil, "write failed")
+
+	err := cc.Write(&Header{Seq: 43}, "hello")
+	_assert(err != nil && strings.Contains(err.Error(), "proto.Message"), "expect a non-proto body rejected, got %v", err)
+
+	_assert(cc.Write(&Header{Seq: 44, Error: "failed"}, struct{}{}) == nil, "write of an empty body failed")
+
+	var got Header
+	var body wrapperspb.StringValue
+	_assert(cc.ReadHeader(&got) == nil && cc.ReadBody(&body) == nil, "read failed")
+	_assert(got.ServiceMethod == h.ServiceMethod && got.Seq == h.Seq && got.Timeout == h.Timeout && got.Kind == h.Kind,
+		"wrong header %+v", got)
+	_assert(len(got.Metadata) == 2 && got.Metadata["trace"] == "t1" && got.Metadata["user"] == "u1", "wrong metadata %v", got.Metadata)
+	_assert(body.Value == "hello", "wrong body %q", body.Value)
+
+	// the rejected body left nothing on the wire
+	_assert(cc.ReadHeader(&got) == nil && cc.ReadBody(nil) == nil, "read failed")
+	_assert(got.Seq == 44 && got.Error == "failed" && got.Metadata == nil, "wrong header %+v", got)
+}
@@ -1,3 +1,14 @@
 module github.com/i0Ek3/rpcie
 
 go 1.18
+
+require (
+	github.com/fxamacker/cbor/v2 v2.5.0
+	github.com/vmihailenco/msgpack/v5 v5.3.5
+	google.golang.org/protobuf v1.28.1
+)
+
+require (
+	github.com/vmihailenco/tagparser/v2 v2.0.0 // indirect
+	github.com/x448/float16 v0.8.4 // indirect
+)
@@ -0,0 +1,164 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ErrUnauthenticated answers the clients failing the authentication,
+// the details are only logged by the server
+var ErrUnauthenticated = Errorf(CodeUnauthenticated, "rpc server: unauthenticated")
+
+// Authenticator verifies the clients in the handshake, see Server.Authenticator
+type Authenticator interface {
+	// Scheme names the authentication, the client must use the same
+	Scheme() string
+	// Challenge returns the data the client must answer, nil if none
+	Challenge() ([]byte, error)
+	// Authenticate verifies the response to challenge and returns
+	// the identity of the client
+	Authenticate(challenge, response []byte) (string, error)
+}
+
+// Credentials answer the challenge of an Authenticator of the same scheme,
+// see Option.Credentials
+type Credentials interface {
+	Scheme() string
+	Respond(challenge []byte) ([]byte, error)
+}
+
+const (
+	AuthToken = "token"
+	AuthHMAC  = "hmac-sha256"
+)
+
+// TokenAuthenticator accepts the clients presenting one of the static
+// Tokens, mapped to the identity of their client. The tokens are sent
+// as they are, so the connections should be served over TLS
+type TokenAuthenticator struct {
+	Tokens map[string]string
+}
+
+func (a *TokenAuthenticator) Scheme() string { return AuthToken }
+
+func (a *TokenAuthenticator) Challenge() ([]byte, error) { return nil, nil }
+
+func (a *TokenAuthenticator) Authenticate(_, response []byte) (string, error) {
+	for token, identity := range a.Tokens {
+		if subtle.ConstantTimeCompare([]byte(token), response) == 1 {
+			return identity, nil
+		}
+	}
+	return "", errors.New("rpc server: invalid token")
+}
+
+// TokenCredentials presents a token to a TokenAuthenticator
+type TokenCredentials string
+
+func (c TokenCredentials) Scheme() string { return AuthToken }
+
+func (c TokenCredentials) Respond([]byte) ([]byte, error) { return []byte(c), nil }
+
+// HMACAuthenticator challenges the clients to sign random bytes with
+// the key shared with their identity, the keys never cross the wire
+type HMACAuthenticator struct {
+	Keys map[string][]byte
+}
+
+// hmacChallengeSize denotes the number of random bytes to sign
+const hmacChallengeSize = 32
+
+func (a *HMACAuthenticator) Scheme() string { return AuthHMAC }
+
+func (a *HMACAuthenticator) Challenge() ([]byte, error) {
+	challenge := make([]byte, hmacChallengeSize)
+	if _, err := rand.Read(challenge); err != nil {
+		return nil, err
+	}
+	return challenge, nil
+}
+
+// Authenticate expects the identity followed by the signature
+func (a *HMACAuthenticator) Authenticate(challenge, response []byte) (string, error) {
+	if len(response) < sha256.Size {
+		return "", errors.New("rpc server: malformed hmac response")
+	}
+	n := len(response) - sha256.Size
+	identity, mac := string(response[:n]), response[n:]
+	key, ok := a.Keys[identity]
+	if !ok || !hmac.Equal(mac, sign(key, challenge)) {
+		return "", fmt.Errorf("rpc server: invalid hmac signature of %q", identity)
+	}
+	return identity, nil
+}
+
+// HMACCredentials answer the challenges of an HMACAuthenticator
+type HMACCredentials struct {
+	Identity string
+	Key      []byte
+}
+
+func (c *HMACCredentials) Scheme() string { return AuthHMAC }
+
+func (c *HMACCredentials) Respond(challenge []byte) ([]byte, error) {
+	return append([]byte(c.Identity), sign(c.Key, challenge)...), nil
+}
+
+func sign(key, challenge []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write(challenge)
+	return h.Sum(nil)
+}
+
+// authMessage is exchanged as JSON lines after the option when the
+// client names an authentication scheme: the server sends a challenge,
+// the client its response, then the server an empty message or an error
+type authMessage struct {
+	Challenge []byte `json:",omitempty"`
+	Response  []byte `json:",omitempty"`
+	Error     string `json:",omitempty"`
+	Code      Code   `json:",omitempty"`
+}
+
+// authenticate runs the authentication of the client of conn,
+// whose identity is set in peer
+func (server *Server) authenticate(dec *json.Decoder, conn io.Writer, opt *Option, peer *Peer) error {
+	auth := server.Authenticator
+	if auth == nil && opt.AuthScheme == "" {
+		return nil
+	}
+	enc := json.NewEncoder(conn)
+	reject := func(err error) error {
+		_ = enc.Encode(&authMessage{Error: ErrUnauthenticated.Error(), Code: CodeUnauthenticated})
+		return err
+	}
+	switch {
+	case auth == nil:
+		return reject(fmt.Errorf("rpc server: no authentication, got scheme %q", opt.AuthScheme))
+	case opt.AuthScheme != auth.Scheme():
+		return reject(fmt.Errorf("rpc server: authentication scheme %q expected, got %q", auth.Scheme(), opt.AuthScheme))
+	}
+	challenge, err := auth.Challenge()
+	if err != nil {
+		return reject(err)
+	}
+	if err := enc.Encode(&authMessage{Challenge: challenge}); err != nil {
+		return err
+	}
+	var msg authMessage
+	if err := dec.Decode(&msg); err != nil {
+		return err
+	}
+	identity, err := auth.Authenticate(challenge, msg.Response)
+	if err != nil {
+		return reject(err)
+	}
+	peer.Identity = identity
+	return enc.Encode(&authMessage{})
+}
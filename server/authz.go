@@ -0,0 +1,117 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log"
+)
+
+// ErrPermissionDenied answers the calls an Authorizer denies, the
+// reason follows it in the error of the response
+var ErrPermissionDenied = Errorf(CodePermissionDenied, "rpc server: permission denied")
+
+// Authorizer decides whether the client of p may call serviceMethod,
+// the error it returns is the reason of the denial
+type Authorizer interface {
+	Authorize(p *Peer, serviceMethod string) error
+}
+
+// Rule allows or denies the calls of the identities matching any of
+// Identities to the methods matching any of Methods. In the patterns,
+// such as "*", "Foo.*" or "spiffe://example.org/*", '*' matches any
+// characters, '/' included, and '?' a single one. An empty identity
+// denotes an anonymous client
+type Rule struct {
+	Identities []string
+	Methods    []string
+	Allow      bool
+}
+
+// Policy evaluates its Rules in order, the first matching a call
+// decides, and a call matching none is denied
+type Policy struct {
+	Rules []Rule
+}
+
+var _ Authorizer = (*Policy)(nil)
+
+func (p *Policy) Authorize(peer *Peer, serviceMethod string) error {
+	var identity string
+	if peer != nil {
+		identity = peer.Identity
+	}
+	for _, r := range p.Rules {
+		if !matchAny(r.Identities, identity) || !matchAny(r.Methods, serviceMethod) {
+			continue
+		}
+		if r.Allow {
+			return nil
+		}
+		return fmt.Errorf("%w: %s is denied to %q", ErrPermissionDenied, serviceMethod, identity)
+	}
+	return fmt.Errorf("%w: %s is not allowed to %q", ErrPermissionDenied, serviceMethod, identity)
+}
+
+func matchAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if match(pattern, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// match reports whether name matches pattern, unlike path.Match
+// a '*' goes past the '/' of identities such as URIs
+func match(pattern, name string) bool {
+	p, n := []rune(pattern), []rune(name)
+	// star is the position in p after the last '*', and next
+	// the one in n it is retried from when the rest fails
+	i, j, star, next := 0, 0, -1, 0
+	for j < len(n) {
+		switch {
+		case i < len(p) && p[i] == '*':
+			i++
+			star, next = i, j
+		case i < len(p) && (p[i] == '?' || p[i] == n[j]):
+			i++
+			j++
+		case star >= 0:
+			next++
+			i, j = star, next
+		default:
+			return false
+		}
+	}
+	for i < len(p) && p[i] == '*' {
+		i++
+	}
+	return i == len(p)
+}
+
+// authorize asks the authorizer of server about the call of serviceMethod by p,
+// the denials are logged for audit and passed to AuditHook
+func (server *Server) authorize(p *Peer, serviceMethod string) error {
+	if server.Authorizer == nil {
+		return nil
+	}
+	err := server.Authorizer.Authorize(p, serviceMethod)
+	if err == nil {
+		return nil
+	}
+	if !errors.Is(err, ErrPermissionDenied) {
+		err = fmt.Errorf("%w: %v", ErrPermissionDenied, err)
+	}
+	var identity, addr string
+	if p != nil {
+		identity = p.Identity
+		if p.Addr != nil {
+			addr = p.Addr.String()
+		}
+	}
+	log.Printf("rpc server: audit: %q from %s denied %s: %v", identity, addr, serviceMethod, err)
+	if server.AuditHook != nil {
+		server.AuditHook(p, serviceMethod, err)
+	}
+	return err
+}
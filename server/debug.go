@@ -14,11 +14,12 @@ const debugText = `<html>
 	Service {{.Name}}
 	<hr>
 		<table>
-		<th align=center>Method</th><th align=center>Calls</th>
+		<th align=center>Method</th><th align=center>Calls</th><th align=center>Panics</th>
 		{{range $name, $mtype := .Method}}
 			<tr>
 			<td align=left font=fixed>{{$name}}({{$mtype.ArgType}}, {{$mtype.ReplyType}}) error</td>
 			<td align=center>{{$mtype.NumCalls}}</td>
+			<td align=center>{{$mtype.NumPanics}}</td>
 			</tr>
 		{{end}}
 		</table>
@@ -34,7 +35,7 @@ type debugHTTP struct {
 
 type debugService struct {
 	Name   string
-	Method map[string]*methodType
+	Method map[string]*MethodType
 }
 
 func (server debugHTTP) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
@@ -0,0 +1,124 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/i0Ek3/rpcie/codec"
+)
+
+// Code classifies the errors sent in the responses, the values
+// are part of the wire format and never change
+type Code uint32
+
+const (
+	// CodeOK is never sent, it denotes no error
+	CodeOK Code = 0
+	// CodeUnknown denotes an error of a service method without a code
+	CodeUnknown Code = 1
+	// CodeInvalidArgument denotes a malformed request
+	CodeInvalidArgument Code = 2
+	// CodeNotFound denotes the service or the method doesn't exist
+	CodeNotFound Code = 3
+	// CodeDeadlineExceeded denotes the call outlived its handle timeout
+	// or the deadline of the client
+	CodeDeadlineExceeded Code = 4
+	// CodeCanceled denotes the call was cancelled
+	CodeCanceled Code = 5
+	// CodeUnavailable denotes the server is shutting down
+	CodeUnavailable Code = 6
+	// CodeBusy denotes the concurrency limits are reached
+	CodeBusy Code = 7
+	// CodeRateLimited denotes a rate limiter rejected the call
+	CodeRateLimited Code = 8
+	// CodeUnauthenticated denotes the client failed the authentication
+	CodeUnauthenticated Code = 9
+	// CodePermissionDenied denotes the authorizer denied the call
+	CodePermissionDenied Code = 10
+	// CodeTooLarge denotes the message exceeds the size limits
+	CodeTooLarge Code = 11
+	// CodeInternal denotes a failure of the server, such as a panic
+	CodeInternal Code = 12
+)
+
+var codeNames = map[Code]string{
+	CodeOK:               "ok",
+	CodeUnknown:          "unknown",
+	CodeInvalidArgument:  "invalid argument",
+	CodeNotFound:         "not found",
+	CodeDeadlineExceeded: "deadline exceeded",
+	CodeCanceled:         "canceled",
+	CodeUnavailable:      "unavailable",
+	CodeBusy:             "busy",
+	CodeRateLimited:      "rate limited",
+	CodeUnauthenticated:  "unauthenticated",
+	CodePermissionDenied: "permission denied",
+	CodeTooLarge:         "too large",
+	CodeInternal:         "internal",
+}
+
+func (c Code) String() string {
+	if name, ok := codeNames[c]; ok {
+		return name
+	}
+	return fmt.Sprintf("code %d", uint32(c))
+}
+
+// Error is an error crossing the wire with its code and details, a
+// service method returns one to give its clients more than a message
+type Error struct {
+	Code    Code
+	Message string
+	Details codec.Metadata
+}
+
+// Errorf returns an *Error of code with the formatted message
+func Errorf(code Code, format string, a ...any) error {
+	return &Error{Code: code, Message: fmt.Sprintf(format, a...)}
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// Is reports whether target is an *Error of the same code and, unless
+// empty, of the same message, which may be followed by a reason. So
+// errors.Is(err, &Error{Code: CodeNotFound}) matches any such error
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	if !ok || t.Code != e.Code {
+		return false
+	}
+	return t.Message == "" || e.Message == t.Message || strings.HasPrefix(e.Message, t.Message+": ")
+}
+
+// toError returns err as an *Error, classifying the errors of the
+// server and of the contexts that carry no code
+func toError(err error) *Error {
+	var e *Error
+	if errors.As(err, &e) {
+		if e.Error() == err.Error() {
+			return e
+		}
+		// keep the context wrapped around e
+		return &Error{Code: e.Code, Message: err.Error(), Details: e.Details}
+	}
+	code := CodeUnknown
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		code = CodeDeadlineExceeded
+	case errors.Is(err, context.Canceled):
+		code = CodeCanceled
+	case errors.Is(err, codec.ErrHeaderTooLarge), errors.Is(err, codec.ErrBodyTooLarge):
+		code = CodeTooLarge
+	}
+	return &Error{Code: code, Message: err.Error()}
+}
+
+// setError sets err in the response header h
+func setError(h *codec.Header, err error) {
+	e := toError(err)
+	h.Error, h.Code, h.Details = e.Message, uint32(e.Code), e.Details
+}
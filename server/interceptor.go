@@ -0,0 +1,74 @@
+package server
+
+import (
+	"context"
+	"log"
+	"reflect"
+	"runtime"
+
+	"github.com/i0Ek3/rpcie/codec"
+)
+
+// UnaryHandler denotes the next step of an interceptor chain,
+// the last one calls the service method with argv
+type UnaryHandler func(ctx context.Context, argv any) (reply any, err error)
+
+// UnaryServerInterceptor wraps the dispatch of every request, it can
+// inspect the header and argument before calling handler, or return
+// an error directly without calling it to reject the request.
+// h is reused by the server once the interceptor returns
+type UnaryServerInterceptor func(ctx context.Context, h *codec.Header, argv any, mtype *MethodType, handler UnaryHandler) (reply any, err error)
+
+// Use appends interceptors to the chain of server, the first one is the
+// outermost. It must be called before the server starts serving
+func (server *Server) Use(interceptors ...UnaryServerInterceptor) {
+	server.interceptors = append(server.interceptors, interceptors...)
+}
+
+// Use appends interceptors to the chain of DefaultServer
+func Use(interceptors ...UnaryServerInterceptor) {
+	DefaultServer.Use(interceptors...)
+}
+
+// invoke calls the service method of req through the interceptor chain,
+// a panic is recovered and returned as an error
+func (server *Server) invoke(ctx context.Context, req *request) (reply any, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			req.mtype.addPanic()
+			err = Errorf(CodeInternal, "rpc server: %s panic: %v", req.h.ServiceMethod, r)
+			log.Println(err)
+			if server.PanicHook != nil {
+				const size = 64 << 10
+				stack := make([]byte, size)
+				stack = stack[:runtime.Stack(stack, false)]
+				server.PanicHook(req.h, r, stack)
+			}
+		}
+	}()
+	handler := func(ctx context.Context, argv any) (any, error) {
+		// an interceptor may pass another argv than the one read
+		v := reflect.ValueOf(argv)
+		if !v.IsValid() || !v.Type().AssignableTo(req.mtype.ArgType) {
+			return nil, Errorf(CodeInvalidArgument, "rpc server: %s expects argv of type %s, got %T", req.h.ServiceMethod, req.mtype.ArgType, argv)
+		}
+		if err := req.svc.call(ctx, req.mtype, v, req.replyv); err != nil {
+			return nil, err
+		}
+		return req.replyv.Interface(), nil
+	}
+	for i := len(server.interceptors) - 1; i >= 0; i-- {
+		interceptor, next := server.interceptors[i], handler
+		handler = func(ctx context.Context, argv any) (any, error) {
+			return interceptor(ctx, req.h, argv, req.mtype, next)
+		}
+	}
+	return handler(ctx, req.argv.Interface())
+}
+
+// UnaryInvoker sends a call to the server and waits for its reply
+type UnaryInvoker func(ctx context.Context, serviceMethod string, args, reply any) error
+
+// UnaryClientInterceptor wraps every call made by a client, it is set
+// through Option.Interceptors and must call invoker to reach the server
+type UnaryClientInterceptor func(ctx context.Context, serviceMethod string, args, reply any, invoker UnaryInvoker) error
@@ -0,0 +1,21 @@
+package server
+
+import (
+	"context"
+
+	"github.com/i0Ek3/rpcie/codec"
+)
+
+type metadataKey struct{}
+
+// MetadataFromContext returns the metadata sent by the client with
+// the request being handled, ctx is the one given to the service
+// method or interceptor
+func MetadataFromContext(ctx context.Context) codec.Metadata {
+	md, _ := ctx.Value(metadataKey{}).(codec.Metadata)
+	return md
+}
+
+func newIncomingContext(ctx context.Context, h *codec.Header) context.Context {
+	return context.WithValue(ctx, metadataKey{}, h.Metadata)
+}
@@ -0,0 +1,58 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+)
+
+// Peer denotes the client at the other end of a connection
+type Peer struct {
+	// Addr is nil if the connection is not a net.Conn
+	Addr net.Addr
+	// TLS is nil if the connection is not served over TLS
+	TLS *tls.ConnectionState
+	// Identity is set by the Server.Authenticator, it defaults to the
+	// common name of the verified client certificate
+	Identity string
+}
+
+// Certificate returns the certificate the client was verified with,
+// nil unless the server verifies its clients, see Server.TLSConfig
+func (p *Peer) Certificate() *x509.Certificate {
+	if p.TLS == nil || len(p.TLS.VerifiedChains) == 0 {
+		return nil
+	}
+	return p.TLS.VerifiedChains[0][0]
+}
+
+type peerKey struct{}
+
+// PeerFromContext returns the client of the request being handled,
+// ctx is the one given to the service method or interceptor
+func PeerFromContext(ctx context.Context) *Peer {
+	p, _ := ctx.Value(peerKey{}).(*Peer)
+	return p
+}
+
+func newPeerContext(ctx context.Context, p *Peer) context.Context {
+	return context.WithValue(ctx, peerKey{}, p)
+}
+
+// newPeer describes the client of conn
+func newPeer(conn io.ReadWriteCloser) *Peer {
+	p := &Peer{}
+	if nc, ok := conn.(net.Conn); ok {
+		p.Addr = nc.RemoteAddr()
+	}
+	if tc, ok := conn.(*tls.Conn); ok {
+		state := tc.ConnectionState()
+		p.TLS = &state
+		if cert := p.Certificate(); cert != nil {
+			p.Identity = cert.Subject.CommonName
+		}
+	}
+	return p
+}
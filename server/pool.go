@@ -0,0 +1,97 @@
+package server
+
+import (
+	"context"
+	"sync"
+)
+
+// ErrServerBusy answers the requests beyond the concurrency limits
+var ErrServerBusy = Errorf(CodeBusy, "rpc server: server is busy")
+
+// defaultQueueFactor sizes the queue of the workers when
+// MaxQueuedRequests is 0, as a multiple of MaxConcurrentRequests
+const defaultQueueFactor = 4
+
+// workerPool runs tasks on at most size goroutines, the tasks beyond
+// wait in a FIFO queue of at most queueSize, negative for an unbounded one.
+// Idle workers exit, so the pool needs no shutdown
+type workerPool struct {
+	size      int
+	queueSize int
+
+	mu      sync.Mutex
+	workers int
+	queue   []func()
+}
+
+// submit runs task on a worker, it reports false if the queue is full
+func (p *workerPool) submit(task func()) bool {
+	p.mu.Lock()
+	if p.workers < p.size {
+		p.workers++
+		p.mu.Unlock()
+		go p.work(task)
+		return true
+	}
+	if p.queueSize >= 0 && len(p.queue) >= p.queueSize {
+		p.mu.Unlock()
+		return false
+	}
+	p.queue = append(p.queue, task)
+	p.mu.Unlock()
+	return true
+}
+
+// work runs task and then the queued ones until the queue is empty
+func (p *workerPool) work(task func()) {
+	for task != nil {
+		task()
+		p.mu.Lock()
+		task = nil
+		if len(p.queue) > 0 {
+			task = p.queue[0]
+			p.queue[0] = nil
+			p.queue = p.queue[1:]
+		} else {
+			p.workers--
+		}
+		p.mu.Unlock()
+	}
+}
+
+// workers returns the pool of server, nil if MaxConcurrentRequests
+// doesn't bound the requests
+func (server *Server) workers() *workerPool {
+	if server.MaxConcurrentRequests <= 0 {
+		return nil
+	}
+	server.poolOnce.Do(func() {
+		queueSize := server.MaxQueuedRequests
+		if queueSize == 0 {
+			queueSize = defaultQueueFactor * server.MaxConcurrentRequests
+		}
+		server.pool = &workerPool{size: server.MaxConcurrentRequests, queueSize: queueSize}
+	})
+	return server.pool
+}
+
+// dispatch handles req on a new goroutine, or on a worker of the pool
+// of server if any, it reports false if the queue of the pool is full.
+// A request cancelled while queued is dropped without calling its method
+func (server *Server) dispatch(ctx context.Context, sc *serverConn, req *request) bool {
+	pool := server.workers()
+	if pool == nil || req.stream != nil {
+		go server.handleRequest(ctx, sc, req)
+		return true
+	}
+	return pool.submit(func() {
+		if ctx.Err() != nil {
+			// cancelled while waiting in the queue
+			sc.untrack(req)
+			sc.wg.Done()
+			freeRequest(req)
+			return
+		}
+		server.handleRequest(ctx, sc, req)
+	})
+}
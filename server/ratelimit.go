@@ -0,0 +1,149 @@
+package server
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/i0Ek3/rpcie/codec"
+)
+
+// ErrRateLimited answers the calls rejected by a RateLimiter
+var ErrRateLimited = Errorf(CodeRateLimited, "rpc server: rate limit exceeded")
+
+// RateLimiter decides whether the server handles a call, it is asked
+// once the request is read and before it waits for a worker. ctx
+// carries the Peer of the connection, h must not be kept
+type RateLimiter interface {
+	Allow(ctx context.Context, h *codec.Header) bool
+}
+
+// KeyFunc derives the key a call is rate limited by
+type KeyFunc func(ctx context.Context, h *codec.Header) string
+
+// ByServer limits all the calls together
+func ByServer(ctx context.Context, h *codec.Header) string {
+	return ""
+}
+
+// ByMethod limits the calls of each service method
+func ByMethod(ctx context.Context, h *codec.Header) string {
+	return h.ServiceMethod
+}
+
+// ByRemoteAddr limits the calls of each client host, the port is
+// ignored as a client gets a new one on every connection
+func ByRemoteAddr(ctx context.Context, h *codec.Header) string {
+	p := PeerFromContext(ctx)
+	if p == nil || p.Addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(p.Addr.String())
+	if err != nil {
+		return p.Addr.String()
+	}
+	return host
+}
+
+// ByMetadata limits the calls by the value of the metadata key, such
+// as the tenant or the user the client acts for
+func ByMetadata(key string) KeyFunc {
+	return func(ctx context.Context, h *codec.Header) string {
+		return h.Metadata[key]
+	}
+}
+
+// minSweep denotes the number of buckets from which the idle ones are dropped
+const minSweep = 1024
+
+// TokenBucketLimiter keeps a token bucket per key, each one allows
+// rate calls per second on average and bursts of up to burst calls
+type TokenBucketLimiter struct {
+	key   KeyFunc
+	rate  float64
+	burst float64
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	sweepAt int
+}
+
+var _ RateLimiter = (*TokenBucketLimiter)(nil)
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter returns a token bucket limiter keyed by key,
+// a burst below 1 allows a single call at once
+func NewRateLimiter(key KeyFunc, rate float64, burst int) *TokenBucketLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &TokenBucketLimiter{
+		key:     key,
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: make(map[string]*bucket),
+		sweepAt: minSweep,
+	}
+}
+
+func (l *TokenBucketLimiter) Allow(ctx context.Context, h *codec.Header) bool {
+	return l.allowAt(l.key(ctx, h), time.Now())
+}
+
+func (l *TokenBucketLimiter) allowAt(key string, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b := l.buckets[key]
+	if b == nil {
+		if len(l.buckets) >= l.sweepAt {
+			l.sweep(now)
+		}
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	l.refill(b, now)
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+func (l *TokenBucketLimiter) refill(b *bucket, now time.Time) {
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens += elapsed.Seconds() * l.rate
+		if b.tokens > l.burst {
+			b.tokens = l.burst
+		}
+		b.last = now
+	}
+}
+
+// sweep drops the buckets refilled to the brim, a new bucket is full
+// anyway, so that the keys seen once don't pile up
+func (l *TokenBucketLimiter) sweep(now time.Time) {
+	for key, b := range l.buckets {
+		if l.refill(b, now); b.tokens >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+	l.sweepAt = 2 * len(l.buckets)
+	if l.sweepAt < minSweep {
+		l.sweepAt = minSweep
+	}
+}
+
+// allow reports whether all the rate limiters of server allow the call
+func (server *Server) allow(ctx context.Context, h *codec.Header) bool {
+	for _, l := range server.RateLimiters {
+		if !l.Allow(ctx, h) {
+			return false
+		}
+	}
+	return true
+}
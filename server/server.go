@@ -1,6 +1,9 @@
 package server
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -11,6 +14,7 @@ import (
 	"reflect"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/i0Ek3/rpcie/codec"
@@ -25,6 +29,10 @@ const (
 	DefaultDebugPath = "/debug/rpcie"
 )
 
+// defaultHandshakeTimeout bounds the TLS handshakes by default,
+// a client can't hold a connection without completing it
+const defaultHandshakeTimeout = 10 * time.Second
+
 // Option denotes the encoding and decoding method of the message
 type Option struct {
 	MagicNumber int
@@ -33,6 +41,34 @@ type Option struct {
 	// timeout control
 	ConnectTimeout time.Duration
 	HandleTimeout  time.Duration
+
+	// FrameVersion selects the framed wire format of codec.FrameConn,
+	// 0 denotes the original unframed stream kept for old peers. The
+	// server doesn't acknowledge it, so it is 0 by default: a server
+	// predating the frames couldn't decode them
+	FrameVersion uint8
+	// Compression compresses the bodies of at least CompressThreshold
+	// bytes both ways, it requires the framed wire format
+	Compression       codec.Compression
+	CompressThreshold int
+
+	// Interceptors wrap the calls made on the client side,
+	// they are local to the client and never sent to the server
+	Interceptors []UnaryClientInterceptor `json:"-"`
+
+	// MaxHeaderSize and MaxBodySize bound the responses read by the
+	// client in bytes, 0 means no limit. They are not sent either
+	MaxHeaderSize int `json:"-"`
+	MaxBodySize   int `json:"-"`
+
+	// TLSConfig makes the client dial over TLS, a certificate set in
+	// it is presented to servers verifying their clients. Not sent
+	TLSConfig *tls.Config `json:"-"`
+
+	// Credentials authenticate the client in the handshake, only
+	// their scheme is sent, as AuthScheme
+	Credentials Credentials `json:"-"`
+	AuthScheme  string
 }
 
 var DefaultOption = &Option{
@@ -44,6 +80,67 @@ var DefaultOption = &Option{
 // Server denotes an RPC Server
 type Server struct {
 	serviceMap sync.Map
+	// interceptors wrap every dispatched call, see Use
+	interceptors []UnaryServerInterceptor
+
+	// PanicHook is called with the recovered value and the stack
+	// when a service method panics, it must be set before serving
+	PanicHook func(h *codec.Header, r any, stack []byte)
+
+	// DefaultHandleTimeout applies to the methods declaring no timeout,
+	// MaxHandleTimeout bounds any timeout, even the one asked by the
+	// client. 0 means no timeout and no bound respectively
+	DefaultHandleTimeout time.Duration
+	MaxHandleTimeout     time.Duration
+
+	// MaxHeaderSize and MaxBodySize bound the requests read in bytes,
+	// 0 means no limit. An oversized body is answered with an error,
+	// the connection is closed if the codec can't skip it
+	MaxHeaderSize int
+	MaxBodySize   int
+
+	// MaxConcurrentRequests bounds the requests handled at once, the
+	// ones beyond wait for a worker in a FIFO queue of at most
+	// MaxQueuedRequests, 4 times MaxConcurrentRequests if 0, unbounded
+	// if negative. MaxConnRequests bounds the requests in flight on a
+	// connection, queued or not. Otherwise 0 means no limit, and a
+	// request beyond the limits is answered with ErrServerBusy.
+	// Streaming calls are long lived, they bypass the workers and only
+	// count for MaxConnRequests. The limits must be set before serving
+	MaxConcurrentRequests int
+	MaxQueuedRequests     int
+	MaxConnRequests       int
+
+	poolOnce sync.Once
+	pool     *workerPool
+
+	// RateLimiters reject the calls any of them doesn't allow with
+	// ErrRateLimited, they must be set before serving
+	RateLimiters []RateLimiter
+
+	// Authenticator makes the clients authenticate in the handshake,
+	// the identity it returns is set in the Peer of the connection.
+	// The clients failing are answered with ErrUnauthenticated
+	Authenticator Authenticator
+
+	// Authorizer decides which methods the clients may call, the calls
+	// it denies are answered with ErrPermissionDenied and its reason.
+	// AuditHook is called with every denial, which is logged anyway
+	Authorizer Authorizer
+	AuditHook  func(p *Peer, serviceMethod string, err error)
+
+	// TLSConfig makes Accept serve the connections over TLS, its
+	// ClientAuth set to tls.RequireAndVerifyClientCert enables mutual
+	// TLS. The handlers find the client certificate in their Peer
+	TLSConfig *tls.Config
+	// HandshakeTimeout bounds the TLS handshake of a connection,
+	// 0 means defaultHandshakeTimeout
+	HandshakeTimeout time.Duration
+
+	mu         sync.Mutex
+	listeners  map[net.Listener]struct{}
+	conns      map[*serverConn]struct{}
+	inShutdown bool
 }
 
 func NewServer() *Server {
@@ -90,33 +187,43 @@ func Register(rcvr any) error {
 	return DefaultServer.Register(rcvr)
 }
 
-func (server *Server) findService(serviceMethod string) (svc *service, mtype *methodType, err error) {
+func (server *Server) findService(serviceMethod string) (svc *service, mtype *MethodType, err error) {
 	dot := strings.LastIndex(serviceMethod, ".")
 	if dot < 0 {
-		err = errors.New("rpc server: servicer/method request ill-formed: " + serviceMethod)
+		err = Errorf(CodeInvalidArgument, "rpc server: servicer/method request ill-formed: %s", serviceMethod)
 		return
 	}
 	serviceName, methodName := serviceMethod[:dot], serviceMethod[dot+1:]
 	svc_, ok := server.serviceMap.Load(serviceName)
 	if !ok {
-		err = errors.New("rpc server: cannot find service " + serviceMethod)
+		err = Errorf(CodeNotFound, "rpc server: cannot find service %s", serviceMethod)
 		return
 	}
 	svc = svc_.(*service)
 	mtype = svc.method[methodName]
 	if mtype == nil {
-		err = errors.New("rpc server: cannot find method " + methodName)
+		err = Errorf(CodeNotFound, "rpc server: cannot find method %s", methodName)
 	}
 	return
 }
 
 func (server *Server) Accept(lis net.Listener) {
+	if !server.trackListener(lis, true) {
+		_ = lis.Close()
+		return
+	}
+	defer server.trackListener(lis, false)
 	for {
 		conn, err := lis.Accept()
 		if err != nil {
-			log.Println("rpc server: accept error:", err)
+			if !server.shuttingDown() {
+				log.Println("rpc server: accept error:", err)
+			}
 			return
 		}
+		if server.TLSConfig != nil {
+			conn = tls.Server(conn, server.TLSConfig)
+		}
 		go server.ServeConn(conn)
 	}
 }
@@ -127,8 +234,23 @@ func Accept(lis net.Listener) {
 
 func (server *Server) ServeConn(conn io.ReadWriteCloser) {
 	defer func() { _ = conn.Close() }()
+	if tc, ok := conn.(*tls.Conn); ok {
+		// complete the handshake, the peer is known from here on
+		timeout := server.HandshakeTimeout
+		if timeout <= 0 {
+			timeout = defaultHandshakeTimeout
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		err := tc.HandshakeContext(ctx)
+		cancel()
+		if err != nil {
+			log.Println("rpc server: tls handshake error:", err)
+			return
+		}
+	}
 	var opt Option
-	if err := json.NewDecoder(conn).Decode(&opt); err != nil {
+	dec := json.NewDecoder(conn)
+	if err := dec.Decode(&opt); err != nil {
 		log.Println("rpc server: options error:", err)
 		return
 	}
@@ -136,70 +258,262 @@ func (server *Server) ServeConn(conn io.ReadWriteCloser) {
 		log.Printf("rpc server: invalid magic number %x", opt.MagicNumber)
 		return
 	}
-	f := codec.NewCodecFuncMap[opt.CodecType]
+	f := codec.Lookup(opt.CodecType)
 	if f == nil {
-		log.Printf("rpc server: invalid codec type %s:", opt.CodecType)
+		err := &CodecError{Type: opt.CodecType, Codecs: codec.Types()}
+		log.Println(err)
+		// tell the client what it could use instead
+		_ = json.NewEncoder(conn).Encode(&codecErrorReply{Error: err.Error(), Codecs: err.Codecs})
+		return
+	}
+	if opt.FrameVersion != 0 && opt.FrameVersion != codec.FrameVersion {
+		log.Printf("rpc server: unsupported frame version %d", opt.FrameVersion)
 		return
 	}
-	server.serveCodec(f(conn), &opt)
+	peer := newPeer(conn)
+	if err := server.authenticate(dec, conn, &opt, peer); err != nil {
+		log.Println("rpc server: authentication error:", err)
+		return
+	}
+	// the decoder may have read ahead into the first request, so the codec
+	// must consume its buffered bytes first, except the newline ending the
+	// JSON line, which is read from conn if the decoder stopped before it.
+	// Only that byte is dropped, a message may start with a space or so
+	buffered, _ := io.ReadAll(dec.Buffered())
+	if len(buffered) == 0 {
+		buffered = make([]byte, 1)
+		if _, err := io.ReadFull(conn, buffered); err != nil {
+			log.Println("rpc server: options error:", err)
+			return
+		}
+	}
+	buffered = bytes.TrimPrefix(buffered, []byte{'\n'})
+	var rwc io.ReadWriteCloser = &optionConn{conn, io.MultiReader(bytes.NewReader(buffered), conn)}
+	if opt.FrameVersion != 0 {
+		rwc = codec.NewFrameConn(rwc)
+	}
+	rwc, err := codec.Compress(rwc, opt.Compression, opt.CompressThreshold)
+	if err != nil {
+		log.Println("rpc server: options error:", err)
+		return
+	}
+	rwc = codec.Limit(rwc, server.MaxHeaderSize, server.MaxBodySize)
+	server.serveCodec(f(rwc), &opt, peer)
+}
+
+// CodecError reports a codec type the server doesn't support,
+// the client gets it when the server rejects its options
+type CodecError struct {
+	Type   codec.Type
+	Codecs []codec.Type
+}
+
+func (e *CodecError) Error() string {
+	return fmt.Sprintf("rpc server: invalid codec type %s, supported codecs are %v", e.Type, e.Codecs)
+}
+
+// codecErrorReply is sent as a JSON line in place of the codec stream
+type codecErrorReply struct {
+	Error  string
+	Codecs []codec.Type
+}
+
+// CodecErrorPrefix denotes how the reply of a CodecError starts,
+// none of the built-in codecs starts a stream of responses so
+const CodecErrorPrefix = `{"Error":`
+
+// optionConn is a connection whose leading bytes are replayed from r
+type optionConn struct {
+	io.ReadWriteCloser
+	r io.Reader
+}
+
+func (c *optionConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
 }
 
 var invalidRequest = struct{}{}
 
-// serveCodec reads and handles request, and then sends response
-func (server *Server) serveCodec(cc codec.Codec, opt *Option) {
+// serverConn holds the state shared by the requests of a connection
+type serverConn struct {
+	cc  codec.Codec
+	opt *Option
 	// sendLock uses to ensure reply to the request
 	// message must be sent one by one
-	sendLock := new(sync.Mutex)
-	wg := new(sync.WaitGroup)
+	sendLock sync.Mutex
+	wg       sync.WaitGroup
+
+	mu sync.Mutex
+	// requests stores the requests being handled, key is seq
+	requests map[uint64]*request
+	// draining denotes the server is shutting down,
+	// no new request will be handled
+	draining bool
+	// maxRequests bounds the requests tracked at once, 0 means no limit
+	maxRequests int
+}
+
+// track makes req cancelable by the client and returns its context,
+// it fails if the connection is draining or has too many requests
+func (sc *serverConn) track(ctx context.Context, req *request) (context.Context, error) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if sc.draining {
+		return nil, ErrServerClosed
+	}
+	if sc.maxRequests > 0 && len(sc.requests) >= sc.maxRequests {
+		return nil, ErrServerBusy
+	}
+	sc.wg.Add(1)
+	ctx, req.cancel = context.WithCancel(ctx)
+	sc.requests[req.h.Seq] = req
+	return ctx, nil
+}
+
+// untrack releases the context of req once it is handled
+func (sc *serverConn) untrack(req *request) {
+	sc.mu.Lock()
+	if sc.requests[req.h.Seq] == req {
+		delete(sc.requests, req.h.Seq)
+	}
+	sc.mu.Unlock()
+	req.cancel()
+}
+
+// cancel aborts the request of seq, the lock is held
+// as req is reused once it is untracked
+func (sc *serverConn) cancel(seq uint64) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if req := sc.requests[seq]; req != nil {
+		req.cancel()
+	}
+}
+
+// serveCodec reads and handles request, and then sends response
+func (server *Server) serveCodec(cc codec.Codec, opt *Option, peer *Peer) {
+	sc := &serverConn{
+		cc:          cc,
+		opt:         opt,
+		requests:    make(map[uint64]*request),
+		maxRequests: server.MaxConnRequests,
+	}
+	if !server.trackConn(sc, true) {
+		_ = cc.Close()
+		return
+	}
+	defer server.trackConn(sc, false)
+	// ctx is cancelled once the connection is closed
+	ctx, cancel := context.WithCancel(newPeerContext(context.Background(), peer))
 	for {
-		req, err := server.readRequest(cc)
-		if err != nil {
-			if req == nil {
-				break
+		req := newRequest()
+		if err := server.readRequestHeader(cc, req.h); err != nil {
+			freeRequest(req)
+			break
+		}
+		switch h := req.h; h.Kind {
+		case codec.KindCancel:
+			_ = cc.ReadBody(nil)
+			sc.cancel(h.Seq)
+			freeRequest(req)
+			continue
+		case codec.KindStream, codec.KindStreamEnd:
+			if err := server.readStreamMessage(sc, h); err != nil {
+				log.Println("rpc server: read stream message err:", err)
 			}
-			req.h.Error = err.Error()
-			server.sendResponse(cc, req.h, invalidRequest, sendLock)
+			freeRequest(req)
+			continue
+		}
+		if err := server.readRequest(cc, req, peer); err != nil {
+			setError(req.h, err)
+			server.sendResponse(sc, req.h, invalidRequest)
+			freeRequest(req)
 			continue
 		}
-		wg.Add(1)
-		go server.handleRequest(cc, req, sendLock, wg, opt.HandleTimeout)
+		if !server.allow(ctx, req.h) {
+			setError(req.h, ErrRateLimited)
+			server.sendResponse(sc, req.h, invalidRequest)
+			freeRequest(req)
+			continue
+		}
+		reqCtx, err := sc.track(ctx, req)
+		if err != nil {
+			setError(req.h, err)
+			server.sendResponse(sc, req.h, invalidRequest)
+			freeRequest(req)
+			continue
+		}
+		if req.mtype.stream {
+			// the stream must be ready before reading its next message
+			req.stream = newStream(server, sc, req, reqCtx.Done())
+			req.replyv = reflect.ValueOf(req.stream)
+		}
+		if !server.dispatch(reqCtx, sc, req) {
+			setError(req.h, ErrServerBusy)
+			server.sendResponse(sc, req.h, invalidRequest)
+			sc.untrack(req)
+			sc.wg.Done()
+			freeRequest(req)
+		}
 	}
-	wg.Wait()
+	cancel()
+	sc.wg.Wait()
 	_ = cc.Close()
 }
 
-// request stores the details of a Call object
+// request stores the details of a Call object,
+// it is pooled and h points to its own header
 type request struct {
-	h *codec.Header
+	h      *codec.Header
+	header codec.Header
 	// request argument
 	argv reflect.Value
 	// request reply
 	replyv reflect.Value
-	mtype  *methodType
+	mtype  *MethodType
 	svc    *service
+	// cancel aborts the context of the request
+	cancel context.CancelFunc
+	// stream is set for the calls of streaming methods
+	stream *Stream
+}
+
+var requestPool = sync.Pool{
+	New: func() any { return new(request) },
+}
+
+func newRequest() *request {
+	req := requestPool.Get().(*request)
+	req.h = &req.header
+	return req
+}
+
+// freeRequest puts req back into the pool, nothing may use it any more
+func freeRequest(req *request) {
+	*req = request{}
+	requestPool.Put(req)
 }
 
-func (server *Server) readRequestHeader(cc codec.Codec) (*codec.Header, error) {
-	var h codec.Header
-	if err := cc.ReadHeader(&h); err != nil {
+func (server *Server) readRequestHeader(cc codec.Codec, h *codec.Header) error {
+	if err := cc.ReadHeader(h); err != nil {
 		if err != io.EOF && err != io.ErrUnexpectedEOF {
 			log.Println("rpc server: read header error:", err)
 		}
-		return nil, err
+		return err
 	}
-	return &h, nil
+	return nil
 }
 
-func (server *Server) readRequest(cc codec.Codec) (*request, error) {
-	h, err := server.readRequestHeader(cc)
-	if err != nil {
-		return nil, err
+func (server *Server) readRequest(cc codec.Codec, req *request, peer *Peer) error {
+	// a denied client doesn't learn whether the method exists
+	err := server.authorize(peer, req.h.ServiceMethod)
+	if err == nil {
+		req.svc, req.mtype, err = server.findService(req.h.ServiceMethod)
 	}
-	req := &request{h: h}
-	req.svc, req.mtype, err = server.findService(h.ServiceMethod)
 	if err != nil {
-		return req, nil
+		// the body must still be consumed to keep the stream in sync
+		_ = cc.ReadBody(nil)
+		return err
 	}
 	// create two input parameter objects
 	req.argv = req.mtype.newArgv()
@@ -212,47 +526,119 @@ func (server *Server) readRequest(cc codec.Codec) (*request, error) {
 	// deserialize the request message into the first input parameter argv
 	if err = cc.ReadBody(argv_); err != nil {
 		log.Println("rpc server: read body err:", err)
-		return req, err
+		if !errors.Is(err, codec.ErrBodyTooLarge) {
+			err = &Error{Code: CodeInvalidArgument, Message: err.Error()}
+		}
+		return err
 	}
-	return req, nil
+	return nil
 }
 
-func (server *Server) sendResponse(cc codec.Codec, h *codec.Header, body any, sendLock *sync.Mutex) {
-	sendLock.Lock()
-	defer sendLock.Unlock()
-	if err := cc.Write(h, body); err != nil {
+// sendResponse writes the response of header h, the fields only meant
+// for the server, such as the metadata, are cleared and not sent back
+func (server *Server) sendResponse(sc *serverConn, h *codec.Header, body any) error {
+	h.Metadata, h.Timeout = nil, 0
+	sc.sendLock.Lock()
+	defer sc.sendLock.Unlock()
+	err := sc.cc.Write(h, body)
+	if err != nil {
 		log.Println("rpc server: write response error:", err)
 	}
+	return err
 }
 
-func (server *Server) handleRequest(cc codec.Codec, req *request, sendLock *sync.Mutex, wg *sync.WaitGroup, timeout time.Duration) {
-	defer wg.Done()
-	called := make(chan struct{})
-	sent := make(chan struct{})
-	go func() {
-		// call method
-		err := req.svc.call(req.mtype, req.argv, req.replyv)
-		called <- struct{}{}
-		if err != nil {
-			req.h.Error = err.Error()
-			server.sendResponse(cc, req.h, invalidRequest, sendLock)
-			sent <- struct{}{}
-			return
-		}
-		// pass replyv to sendResponse to complete serialization
-		server.sendResponse(cc, req.h, req.replyv.Interface(), sendLock)
-		sent <- struct{}{}
-	}()
+// handleRequest calls the method of req with ctx, which is cancelled
+// when the client cancels the call or the handle timeout fires.
+// The response of a cancelled request is not sent, and a single response
+// is sent per request: the result of a method returning after its handle
+// timeout fired is discarded. A streaming call
+// is not limited by the handle timeout, and its response is the frame
+// ending the stream
+func (server *Server) handleRequest(ctx context.Context, sc *serverConn, req *request) {
+	defer sc.wg.Done()
+	cancelled := ctx
+	if len(req.h.Metadata) > 0 {
+		ctx = newIncomingContext(ctx, req.h)
+	}
+	// the client's deadline is sent as the time remaining
+	if req.h.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, req.h.Timeout)
+		defer cancel()
+	}
+	timeout := server.handleTimeout(sc, req.mtype)
+	if req.stream != nil {
+		req.stream.ctx = ctx
+		req.h.Kind = codec.KindStreamEnd
+		timeout = 0
+	}
+	var (
+		responded int32
+		timedOut  chan struct{}
+		deadline  time.Time
+	)
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		deadline = time.Now().Add(timeout)
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+		defer cancel()
+		// the timeout response is written from a copy, the handler
+		// and the interceptors may still be reading req.h
+		th := *req.h
+		timedOut = make(chan struct{})
+		timer := time.AfterFunc(timeout, func() {
+			defer close(timedOut)
+			if atomic.CompareAndSwapInt32(&responded, 0, 1) && cancelled.Err() == nil {
+				setError(&th, Errorf(CodeDeadlineExceeded, "rpc server: request handle timeout: expect within %s", timeout))
+				server.sendResponse(sc, &th, invalidRequest)
+			}
+		})
+		defer timer.Stop()
+	}
+	// call method through the interceptor chain, a handler outliving
+	// its timeout still runs to the end but its result is discarded
+	reply, err := server.invoke(ctx, req)
+	// a result at the deadline is late too, a handler returning as
+	// its context expires must not beat the timeout response
+	if timedOut == nil || time.Now().Before(deadline) && atomic.CompareAndSwapInt32(&responded, 0, 1) {
+		server.respond(cancelled, sc, req, reply, err)
+	} else {
+		// wait for the timeout response, the connection may be
+		// closed as soon as the request is done
+		<-timedOut
+	}
+	sc.untrack(req)
+	freeRequest(req)
+}
+
+// handleTimeout returns the smaller of the timeouts asked by the client
+// and configured on the server for mtype, bounded by MaxHandleTimeout
+func (server *Server) handleTimeout(sc *serverConn, mtype *MethodType) time.Duration {
+	timeout := mtype.timeout
 	if timeout == 0 {
-		<-called
-		<-sent
+		timeout = server.DefaultHandleTimeout
+	}
+	for _, t := range []time.Duration{sc.opt.HandleTimeout, server.MaxHandleTimeout} {
+		if t > 0 && (timeout == 0 || t < timeout) {
+			timeout = t
+		}
+	}
+	return timeout
+}
+
+// respond sends the result of the call of req unless it was cancelled
+func (server *Server) respond(cancelled context.Context, sc *serverConn, req *request, reply any, err error) {
+	if cancelled.Err() != nil {
+		return
+	}
+	if err != nil {
+		setError(req.h, err)
+		server.sendResponse(sc, req.h, invalidRequest)
 		return
 	}
-	select {
-	case <-time.After(timeout):
-		req.h.Error = fmt.Sprintf("rpc server: request handle timeout: expect within %s", timeout)
-		server.sendResponse(cc, req.h, invalidRequest, sendLock)
-	case <-called:
-		<-sent
+	if req.stream != nil {
+		reply = invalidRequest
 	}
+	// pass reply to sendResponse to complete serialization
+	server.sendResponse(sc, req.h, reply)
 }
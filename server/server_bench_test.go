@@ -0,0 +1,35 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/i0Ek3/rpcie/codec"
+)
+
+func BenchmarkServerCall(b *testing.B) {
+	var foo Foo
+	server := NewServer()
+	_ = server.Register(&foo)
+	for _, opt := range []*Option{
+		{MagicNumber: MagicNumber, CodecType: codec.GobType},
+		{MagicNumber: MagicNumber, CodecType: codec.GobType, FrameVersion: codec.FrameVersion},
+		{MagicNumber: MagicNumber, CodecType: codec.JsonType, FrameVersion: codec.FrameVersion},
+	} {
+		name := string(opt.CodecType)
+		if opt.FrameVersion != 0 {
+			name += " framed"
+		}
+		b.Run(name, func(b *testing.B) {
+			cc := dialServer(server, opt)
+			defer func() { _ = cc.Close() }()
+			var reply int
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := callServer(cc, "Foo.Sum", Args{Inta: i, Intb: 1}, &reply); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
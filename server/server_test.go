@@ -0,0 +1,717 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/i0Ek3/rpcie/codec"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// dialServer serves one end of a pipe with server and returns
+// a codec of opt on the other end after the option exchange
+func dialServer(server *Server, opt *Option) codec.Codec {
+	conn, srvConn := net.Pipe()
+	go server.ServeConn(srvConn)
+	_ = json.NewEncoder(conn).Encode(opt)
+	var rwc io.ReadWriteCloser = conn
+	if opt.FrameVersion != 0 {
+		rwc = codec.NewFrameConn(conn)
+	}
+	rwc, _ = codec.Compress(rwc, opt.Compression, opt.CompressThreshold)
+	return codec.Lookup(opt.CodecType)(rwc)
+}
+
+func callServer(cc codec.Codec, serviceMethod string, args, reply any) (*codec.Header, error) {
+	if err := cc.Write(&codec.Header{ServiceMethod: serviceMethod, Seq: 1}, args); err != nil {
+		return nil, err
+	}
+	var h codec.Header
+	if err := cc.ReadHeader(&h); err != nil {
+		return nil, err
+	}
+	if h.Error != "" {
+		return &h, cc.ReadBody(nil)
+	}
+	return &h, cc.ReadBody(reply)
+}
+
+func TestServerInterceptor(t *testing.T) {
+	var foo Foo
+	server := NewServer()
+	_ = server.Register(&foo)
+	var trace []string
+	server.Use(
+		func(ctx context.Context, h *codec.Header, argv any, mtype *MethodType, handler UnaryHandler) (any, error) {
+			trace = append(trace, "outer:"+h.ServiceMethod)
+			return handler(ctx, argv)
+		},
+		func(ctx context.Context, h *codec.Header, argv any, mtype *MethodType, handler UnaryHandler) (any, error) {
+			trace = append(trace, "inner:"+mtype.Name())
+			switch args := argv.(Args); {
+			case args.Inta < 0:
+				return nil, errors.New("negative argument")
+			case args.Inta == 100:
+				return handler(ctx, nil)
+			case args.Inta == 101:
+				return handler(ctx, &args)
+			}
+			return handler(ctx, argv)
+		},
+	)
+	cc := dialServer(server, DefaultOption)
+	defer func() { _ = cc.Close() }()
+
+	var reply int
+	h, err := callServer(cc, "Foo.Sum", Args{Inta: 1, Intb: 2}, &reply)
+	_assert(err == nil && h.Error == "" && reply == 3, "failed to call Foo.Sum through interceptors")
+	_assert(len(trace) == 2 && trace[0] == "outer:Foo.Sum" && trace[1] == "inner:Sum", "wrong interceptor order: %v", trace)
+
+	h, err = callServer(cc, "Foo.Sum", Args{Inta: -1, Intb: 2}, &reply)
+	_assert(err == nil && h.Error == "negative argument", "expect the interceptor to reject the call")
+	_, mtype, _ := server.findService("Foo.Sum")
+	_assert(mtype.NumCalls() == 1, "rejected call shouldn't reach Foo.Sum")
+
+	for _, inta := range []int{100, 101} {
+		h, err = callServer(cc, "Foo.Sum", Args{Inta: inta}, &reply)
+		_assert(err == nil && Code(h.Code) == CodeInvalidArgument && strings.Contains(h.Error, "expects argv of type server.Args"),
+			"expect an invalid argv to be rejected, got %q", h.Error)
+	}
+	_assert(mtype.NumCalls() == 1 && mtype.NumPanics() == 0, "invalid argv shouldn't reach Foo.Sum")
+}
+
+func TestResponseHeader(t *testing.T) {
+	server := NewServer()
+	_ = server.Register(new(Foo))
+	_ = server.Register(make(Waiter, 1))
+	cc := dialServer(server, &Option{MagicNumber: MagicNumber, CodecType: codec.GobType, HandleTimeout: 50 * time.Millisecond})
+	defer func() { _ = cc.Close() }()
+
+	for _, serviceMethod := range []string{"Foo.Sum", "Waiter.Wait"} {
+		h := &codec.Header{ServiceMethod: serviceMethod, Seq: 1, Metadata: codec.Metadata{"authorization": "Bearer s3cret"}, Timeout: time.Hour}
+		var args any = Args{Inta: 1}
+		if serviceMethod == "Waiter.Wait" {
+			args = 1
+		}
+		_ = cc.Write(h, args)
+		var rh codec.Header
+		_assert(cc.ReadHeader(&rh) == nil && cc.ReadBody(nil) == nil, "failed to read the response of %s", serviceMethod)
+		_assert(rh.Seq == 1 && rh.Metadata == nil && rh.Timeout == 0, "expect %s to send back no metadata nor timeout, got %+v", serviceMethod, rh)
+	}
+}
+
+type Waiter chan error
+
+// Wait blocks until the context of the request is done
+func (w Waiter) Wait(ctx context.Context, args int, reply *int) error {
+	<-ctx.Done()
+	w <- ctx.Err()
+	return ctx.Err()
+}
+
+func TestHandleContext(t *testing.T) {
+	w := make(Waiter, 1)
+	server := NewServer()
+	_ = server.Register(w)
+
+	t.Run("handle timeout", func(t *testing.T) {
+		cc := dialServer(server, &Option{MagicNumber: MagicNumber, CodecType: codec.GobType, HandleTimeout: 100 * time.Millisecond})
+		defer func() { _ = cc.Close() }()
+		var reply int
+		h, err := callServer(cc, "Waiter.Wait", 1, &reply)
+		_assert(err == nil && strings.Contains(h.Error, "handle timeout"), "expect a timeout error")
+		_assert(<-w == context.DeadlineExceeded, "expect the context to exceed its deadline")
+	})
+	t.Run("cancel frame", func(t *testing.T) {
+		var foo Foo
+		_ = server.Register(&foo)
+		cc := dialServer(server, DefaultOption)
+		defer func() { _ = cc.Close() }()
+		_ = cc.Write(&codec.Header{ServiceMethod: "Waiter.Wait", Seq: 1}, 1)
+		_ = cc.Write(&codec.Header{Seq: 1, Kind: codec.KindCancel}, struct{}{})
+		_assert(<-w == context.Canceled, "expect the context to be cancelled")
+		var reply int
+		h, err := callServer(cc, "Foo.Sum", Args{Inta: 1, Intb: 2}, &reply)
+		_assert(err == nil && h.ServiceMethod == "Foo.Sum" && reply == 3, "expect no response for the cancelled call")
+	})
+	t.Run("connection closed", func(t *testing.T) {
+		cc := dialServer(server, DefaultOption)
+		_ = cc.Write(&codec.Header{ServiceMethod: "Waiter.Wait", Seq: 1}, 1)
+		_ = cc.Close()
+		_assert(<-w == context.Canceled, "expect the context to be cancelled")
+	})
+}
+
+type Panicker int
+
+func (p Panicker) Boom(args int, reply *int) error {
+	panic("boom")
+}
+
+func TestPanicRecovery(t *testing.T) {
+	var p Panicker
+	var foo Foo
+	server := NewServer()
+	_ = server.Register(&p)
+	_ = server.Register(&foo)
+	var stack []byte
+	server.PanicHook = func(h *codec.Header, r any, s []byte) {
+		stack = s
+	}
+	cc := dialServer(server, DefaultOption)
+	defer func() { _ = cc.Close() }()
+
+	var reply int
+	h, err := callServer(cc, "Panicker.Boom", 1, &reply)
+	_assert(err == nil && strings.Contains(h.Error, "panic: boom"), "expect the panic in the response")
+	_assert(bytes.Contains(stack, []byte("Boom")), "expect the stack of the panic")
+	_, mtype, _ := server.findService("Panicker.Boom")
+	_assert(mtype.NumPanics() == 1, "expect the panic to be counted")
+
+	h, err = callServer(cc, "Foo.Missing", Args{}, &reply)
+	_assert(err == nil && strings.Contains(h.Error, "cannot find method"), "expect an unknown method error")
+	h, err = callServer(cc, "Foo.Sum", Args{Inta: 1, Intb: 2}, &reply)
+	_assert(err == nil && h.Error == "" && reply == 3, "expect the connection to stay usable")
+}
+
+type Echo int
+
+func (e Echo) Echo(s string, reply *string) error {
+	*reply = s
+	return nil
+}
+
+func TestMaxBodySize(t *testing.T) {
+	var echo Echo
+	server := NewServer()
+	_ = server.Register(&echo)
+	server.MaxBodySize = 64
+	large := strings.Repeat("x", 64<<10)
+
+	for _, tt := range []struct {
+		name string
+		opt  *Option
+		// alive denotes the connection survives an oversized body
+		alive bool
+	}{
+		{"framed json", &Option{MagicNumber: MagicNumber, CodecType: codec.JsonType, FrameVersion: codec.FrameVersion}, true},
+		{"framed gob", DefaultOption, false},
+		{"unframed gob", &Option{MagicNumber: MagicNumber, CodecType: codec.GobType}, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			cc := dialServer(server, tt.opt)
+			defer func() { _ = cc.Close() }()
+			var reply string
+			h, err := callServer(cc, "Echo.Echo", "ok", &reply)
+			_assert(err == nil && h.Error == "" && reply == "ok", "failed to call Echo.Echo: %v", err)
+
+			// the server may stop reading the pipe before the whole body is written
+			go func() { _ = cc.Write(&codec.Header{ServiceMethod: "Echo.Echo", Seq: 2}, large) }()
+			h = &codec.Header{}
+			_assert(cc.ReadHeader(h) == nil, "expect a response to the oversized body")
+			_assert(h.Seq == 2 && h.Error == codec.ErrBodyTooLarge.Error(), "expect a size error, got %q", h.Error)
+			_ = cc.ReadBody(nil)
+
+			h, err = callServer(cc, "Echo.Echo", "ok", &reply)
+			if tt.alive {
+				_assert(err == nil && h.Error == "" && reply == "ok", "expect the connection to survive: %v", err)
+			} else {
+				_assert(err != nil, "expect the connection to be closed")
+			}
+		})
+	}
+}
+
+func TestCompression(t *testing.T) {
+	var echo Echo
+	server := NewServer()
+	_ = server.Register(&echo)
+	// the limit applies to the decompressed body
+	server.MaxBodySize = 64 << 10
+	cc := dialServer(server, &Option{
+		MagicNumber:  MagicNumber,
+		CodecType:    codec.JsonType,
+		FrameVersion: codec.FrameVersion,
+		Compression:  codec.CompressionGzip,
+	})
+	defer func() { _ = cc.Close() }()
+
+	for _, s := range []string{"small", strings.Repeat("rpcie ", 10000)} {
+		var reply string
+		h, err := callServer(cc, "Echo.Echo", s, &reply)
+		_assert(err == nil && h.Error == "" && reply == s, "failed to call Echo.Echo: %v %q", err, h.Error)
+	}
+	var reply string
+	h, err := callServer(cc, "Echo.Echo", strings.Repeat("rpcie ", 20000), &reply)
+	_assert(err == nil && h.Error == codec.ErrBodyTooLarge.Error(), "expect a size error, got %v %q", err, h.Error)
+}
+
+type Greeter int
+
+func (g Greeter) Hello(name *wrapperspb.StringValue, reply *wrapperspb.StringValue) error {
+	reply.Value = "hello " + name.Value
+	return nil
+}
+
+func TestProtobufCodec(t *testing.T) {
+	var g Greeter
+	server := NewServer()
+	_ = server.Register(&g)
+	cc := dialServer(server, &Option{MagicNumber: MagicNumber, CodecType: codec.ProtobufType, FrameVersion: codec.FrameVersion})
+	defer func() { _ = cc.Close() }()
+
+	var reply wrapperspb.StringValue
+	h, err := callServer(cc, "Greeter.Hello", wrapperspb.String("rpcie"), &reply)
+	_assert(err == nil && h.Error == "" && reply.Value == "hello rpcie", "failed to call Greeter.Hello: %v %q", err, h.Error)
+
+	h, err = callServer(cc, "Greeter.Bye", wrapperspb.String("rpcie"), &reply)
+	_assert(err == nil && strings.Contains(h.Error, "cannot find method"), "expect an error response, got %v %q", err, h.Error)
+}
+
+type bufferConn struct {
+	*bytes.Buffer
+}
+
+func (bufferConn) Close() error { return nil }
+
+func TestOptionReadAhead(t *testing.T) {
+	var g Greeter
+	server := NewServer()
+	_ = server.Register(&g)
+	opt := &Option{MagicNumber: MagicNumber, CodecType: codec.ProtobufType}
+	// the protobuf headers of 26 to 34 bytes, one starts with a space
+	for n := 0; n <= 8; n++ {
+		conn, srvConn := net.Pipe()
+		go server.ServeConn(srvConn)
+		// the option and the request are sent at once,
+		// so the decoder of the option reads ahead
+		var buf bytes.Buffer
+		_ = json.NewEncoder(&buf).Encode(opt)
+		h := &codec.Header{ServiceMethod: "Greeter.Hello", Seq: 1, Metadata: codec.Metadata{"pad": strings.Repeat("x", n)}}
+		_ = codec.NewProtobufCodec(bufferConn{&buf}).Write(h, wrapperspb.String("rpcie"))
+		_ = conn.SetDeadline(time.Now().Add(time.Second))
+		go func() { _, _ = conn.Write(buf.Bytes()) }()
+
+		cc := codec.NewProtobufCodec(conn)
+		var rh codec.Header
+		var reply wrapperspb.StringValue
+		err := cc.ReadHeader(&rh)
+		if err == nil {
+			err = cc.ReadBody(&reply)
+		}
+		_ = cc.Close()
+		_assert(err == nil && rh.Error == "" && reply.Value == "hello rpcie", "failed to call with a header padded by %d: %v %q", n, err, rh.Error)
+	}
+}
+
+func TestHandshakeTimeout(t *testing.T) {
+	server := &Server{HandshakeTimeout: 50 * time.Millisecond}
+	conn, srvConn := net.Pipe()
+	defer func() { _ = conn.Close() }()
+	done := make(chan struct{})
+	go func() {
+		// the client never sends its hello
+		server.ServeConn(tls.Server(srvConn, &tls.Config{}))
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		_assert(false, "expect the handshake to time out")
+	}
+}
+
+func TestUnsupportedCodec(t *testing.T) {
+	conn, srvConn := net.Pipe()
+	go NewServer().ServeConn(srvConn)
+	_ = json.NewEncoder(conn).Encode(&Option{MagicNumber: MagicNumber, CodecType: "application/unknown"})
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	_assert(err == nil && strings.HasPrefix(line, CodecErrorPrefix), "expect a codec error reply, got %q %v", line, err)
+	var reply codecErrorReply
+	_ = json.Unmarshal([]byte(line), &reply)
+	_assert(strings.Contains(reply.Error, "application/unknown") && len(reply.Codecs) == len(codec.Types()),
+		"expect the supported codecs listed, got %+v", reply)
+}
+
+type Sleeper int
+
+func (s Sleeper) Sleep(ms int, reply *int) error {
+	time.Sleep(time.Duration(ms) * time.Millisecond)
+	*reply = ms
+	return nil
+}
+
+func (s Sleeper) Quick(ms int, reply *int) error {
+	return s.Sleep(ms, reply)
+}
+
+func (s Sleeper) HandleTimeouts() map[string]time.Duration {
+	return map[string]time.Duration{"Sleep": 50 * time.Millisecond}
+}
+
+func TestHandleTimeout(t *testing.T) {
+	var s Sleeper
+	server := NewServer()
+	_ = server.Register(&s)
+	_, sleep, _ := server.findService("Sleeper.Sleep")
+	_, quick, _ := server.findService("Sleeper.Quick")
+	_assert(sleep.Timeout() == 50*time.Millisecond && quick.Timeout() == 0, "expect the declared timeouts")
+
+	for _, tt := range []struct {
+		client, def, max time.Duration
+		mtype            *MethodType
+		want             time.Duration
+	}{
+		{0, 0, 0, quick, 0},
+		{0, time.Second, 0, quick, time.Second},
+		{0, time.Second, 0, sleep, 50 * time.Millisecond},
+		{10 * time.Millisecond, time.Second, 0, sleep, 10 * time.Millisecond},
+		{time.Second, 0, 0, sleep, 50 * time.Millisecond},
+		{time.Second, 0, 0, quick, time.Second},
+		{0, 0, 20 * time.Millisecond, sleep, 20 * time.Millisecond},
+		{time.Minute, time.Hour, time.Second, quick, time.Second},
+	} {
+		server.DefaultHandleTimeout, server.MaxHandleTimeout = tt.def, tt.max
+		sc := &serverConn{opt: &Option{HandleTimeout: tt.client}}
+		got := server.handleTimeout(sc, tt.mtype)
+		_assert(got == tt.want, "client %s, default %s, max %s, method %s: expect %s, got %s",
+			tt.client, tt.def, tt.max, tt.mtype.Name(), tt.want, got)
+	}
+
+	server.DefaultHandleTimeout, server.MaxHandleTimeout = 0, 0
+	cc := dialServer(server, DefaultOption)
+	defer func() { _ = cc.Close() }()
+	var reply int
+	h, err := callServer(cc, "Sleeper.Sleep", 200, &reply)
+	_assert(err == nil && strings.Contains(h.Error, "expect within 50ms"), "expect the declared timeout to fire, got %v %q", err, h.Error)
+}
+
+func TestHandleTimeoutLeak(t *testing.T) {
+	var s Sleeper
+	server := NewServer()
+	_ = server.Register(&s)
+	cc := dialServer(server, DefaultOption)
+	defer func() { _ = cc.Close() }()
+	var reply int
+	_, _ = callServer(cc, "Sleeper.Quick", 1, &reply)
+	base := runtime.NumGoroutine()
+
+	for i := 0; i < 5; i++ {
+		h, err := callServer(cc, "Sleeper.Sleep", 100, &reply)
+		_assert(err == nil && strings.Contains(h.Error, "handle timeout"), "expect a timeout, got %v %q", err, h.Error)
+	}
+	// the late results must be discarded rather than sent after the timeouts
+	time.Sleep(150 * time.Millisecond)
+	reply = 0
+	h, err := callServer(cc, "Sleeper.Quick", 1, &reply)
+	_assert(err == nil && h.Error == "" && reply == 1, "expect no duplicate response, got %v %q %d", err, h.Error, reply)
+
+	n := runtime.NumGoroutine()
+	for deadline := time.Now().Add(time.Second); n > base && time.Now().Before(deadline); n = runtime.NumGoroutine() {
+		time.Sleep(10 * time.Millisecond)
+	}
+	_assert(n <= base, "expect the handlers to exit, %d goroutines left of %d", n, base)
+}
+
+// Gate blocks its calls until released
+type Gate struct {
+	entered chan int
+	release chan struct{}
+}
+
+func (g *Gate) Pass(n int, reply *int) error {
+	g.entered <- n
+	<-g.release
+	*reply = n
+	return nil
+}
+
+func TestConcurrencyLimits(t *testing.T) {
+	newGate := func() *Gate {
+		return &Gate{entered: make(chan int, 3), release: make(chan struct{})}
+	}
+	read := func(cc codec.Codec) (codec.Header, int) {
+		var h codec.Header
+		var reply int
+		_ = cc.ReadHeader(&h)
+		if h.Error != "" {
+			_ = cc.ReadBody(nil)
+		} else {
+			_ = cc.ReadBody(&reply)
+		}
+		return h, reply
+	}
+
+	t.Run("server queue", func(t *testing.T) {
+		g := newGate()
+		server := NewServer()
+		server.MaxConcurrentRequests, server.MaxQueuedRequests = 1, 1
+		_ = server.Register(g)
+		cc := dialServer(server, DefaultOption)
+		defer func() { _ = cc.Close() }()
+		go func() {
+			_ = cc.Write(&codec.Header{ServiceMethod: "Gate.Pass", Seq: 1}, 1)
+			<-g.entered
+			_ = cc.Write(&codec.Header{ServiceMethod: "Gate.Pass", Seq: 2}, 2)
+			_ = cc.Write(&codec.Header{ServiceMethod: "Gate.Pass", Seq: 3}, 3)
+		}()
+		h, _ := read(cc)
+		_assert(h.Seq == 3 && h.Error == ErrServerBusy.Error(), "expect the call beyond the queue to be rejected, got %+v", h)
+		close(g.release)
+		for seq := uint64(1); seq <= 2; seq++ {
+			h, reply := read(cc)
+			_assert(h.Seq == seq && h.Error == "" && reply == int(seq), "expect the calls in order, got %+v %d", h, reply)
+		}
+		_assert(<-g.entered == 2, "expect the queued call to run")
+	})
+	t.Run("default queue", func(t *testing.T) {
+		g := &Gate{entered: make(chan int, 6), release: make(chan struct{})}
+		server := NewServer()
+		server.MaxConcurrentRequests = 1
+		_ = server.Register(g)
+		cc := dialServer(server, DefaultOption)
+		defer func() { _ = cc.Close() }()
+		go func() {
+			_ = cc.Write(&codec.Header{ServiceMethod: "Gate.Pass", Seq: 1}, 1)
+			<-g.entered
+			for seq := uint64(2); seq <= 6; seq++ {
+				_ = cc.Write(&codec.Header{ServiceMethod: "Gate.Pass", Seq: seq}, int(seq))
+			}
+		}()
+		h, _ := read(cc)
+		_assert(h.Seq == 6 && h.Error == ErrServerBusy.Error(), "expect the queue bounded to 4 calls, got %+v", h)
+		close(g.release)
+		for i := 0; i < 5; i++ {
+			h, _ := read(cc)
+			_assert(h.Error == "", "expect the queued calls to run, got %+v", h)
+		}
+	})
+	t.Run("unbounded queue", func(t *testing.T) {
+		g := &Gate{entered: make(chan int, 6), release: make(chan struct{})}
+		server := NewServer()
+		server.MaxConcurrentRequests, server.MaxQueuedRequests = 1, -1
+		_ = server.Register(g)
+		cc := dialServer(server, DefaultOption)
+		defer func() { _ = cc.Close() }()
+		go func() {
+			for seq := uint64(1); seq <= 6; seq++ {
+				_ = cc.Write(&codec.Header{ServiceMethod: "Gate.Pass", Seq: seq}, int(seq))
+			}
+			<-g.entered
+			close(g.release)
+		}()
+		for i := 0; i < 6; i++ {
+			h, _ := read(cc)
+			_assert(h.Error == "", "expect the calls beyond the workers to be queued, got %+v", h)
+		}
+	})
+	t.Run("connection limit", func(t *testing.T) {
+		g := newGate()
+		server := NewServer()
+		server.MaxConnRequests = 1
+		_ = server.Register(g)
+		cc := dialServer(server, DefaultOption)
+		defer func() { _ = cc.Close() }()
+		go func() {
+			_ = cc.Write(&codec.Header{ServiceMethod: "Gate.Pass", Seq: 1}, 1)
+			<-g.entered
+			_ = cc.Write(&codec.Header{ServiceMethod: "Gate.Pass", Seq: 2}, 2)
+		}()
+		h, _ := read(cc)
+		_assert(h.Seq == 2 && h.Error == ErrServerBusy.Error(), "expect the second call to be rejected, got %+v", h)
+		close(g.release)
+		h, reply := read(cc)
+		_assert(h.Seq == 1 && reply == 1, "expect the first call to complete, got %+v %d", h, reply)
+	})
+}
+
+func TestWorkerPool(t *testing.T) {
+	p := &workerPool{size: 1, queueSize: 3}
+	var (
+		mu      sync.Mutex
+		running int
+		peak    int
+		order   []int
+		wg      sync.WaitGroup
+	)
+	release := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		i := i
+		wg.Add(1)
+		ok := p.submit(func() {
+			defer wg.Done()
+			mu.Lock()
+			running++
+			if running > peak {
+				peak = running
+			}
+			order = append(order, i)
+			mu.Unlock()
+			<-release
+			mu.Lock()
+			running--
+			mu.Unlock()
+		})
+		_assert(ok, "expect task %d to be accepted", i)
+	}
+	_assert(!p.submit(func() {}), "expect a full queue to reject the task")
+	close(release)
+	wg.Wait()
+	_assert(peak == 1, "expect a single worker, got %d", peak)
+	for i, n := range order {
+		_assert(n == i, "expect the tasks in order, got %v", order)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_assert(p.workers == 0 && len(p.queue) == 0, "expect the workers to exit once idle")
+}
+
+func TestRateLimit(t *testing.T) {
+	var foo Foo
+	server := NewServer()
+	_ = server.Register(&foo)
+	_ = server.Register(new(Sleeper))
+	server.RateLimiters = []RateLimiter{NewRateLimiter(ByMethod, 0.01, 2)}
+	cc := dialServer(server, DefaultOption)
+	defer func() { _ = cc.Close() }()
+	var reply int
+	for i := 0; i < 2; i++ {
+		h, err := callServer(cc, "Foo.Sum", Args{Inta: 1, Intb: 2}, &reply)
+		_assert(err == nil && h.Error == "" && reply == 3, "expect the burst to pass, got %v %q", err, h.Error)
+	}
+	h, err := callServer(cc, "Foo.Sum", Args{Inta: 1, Intb: 2}, &reply)
+	_assert(err == nil && h.Error == ErrRateLimited.Error(), "expect the call beyond the burst to be rejected, got %v %q", err, h.Error)
+	h, err = callServer(cc, "Sleeper.Quick", 0, &reply)
+	_assert(err == nil && h.Error == "", "expect the other method not to be limited, got %v %q", err, h.Error)
+}
+
+func TestTokenBucketLimiter(t *testing.T) {
+	l := NewRateLimiter(ByServer, 10, 2)
+	now := time.Now()
+	_assert(l.allowAt("", now) && l.allowAt("", now) && !l.allowAt("", now), "expect a burst of 2")
+	_assert(!l.allowAt("", now.Add(50*time.Millisecond)), "expect half a token after 50ms")
+	_assert(l.allowAt("", now.Add(100*time.Millisecond)), "expect a token after 100ms")
+	_assert(l.allowAt("", now.Add(time.Hour)) && l.allowAt("", now.Add(time.Hour)) && !l.allowAt("", now.Add(time.Hour)),
+		"expect the tokens to be capped by the burst")
+
+	l = NewRateLimiter(ByMethod, 10, 2)
+	for i := 0; i < minSweep; i++ {
+		l.allowAt(fmt.Sprint(i), now)
+	}
+	l.allowAt("last", now.Add(time.Second))
+	_assert(len(l.buckets) == 1, "expect the idle buckets to be dropped, got %d", len(l.buckets))
+
+	peer := &Peer{Addr: &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 4321}}
+	key := ByRemoteAddr(newPeerContext(context.Background(), peer), &codec.Header{})
+	_assert(key == "10.0.0.1", "expect the host as key, got %q", key)
+}
+
+func TestPolicy(t *testing.T) {
+	policy := &Policy{Rules: []Rule{
+		{Identities: []string{"admin"}, Methods: []string{"*"}, Allow: true},
+		{Identities: []string{"spiffe://example.org/*"}, Methods: []string{"Foo.*"}, Allow: true},
+		{Identities: []string{"*"}, Methods: []string{"Foo.Delete"}},
+		{Identities: []string{"?*"}, Methods: []string{"Foo.*"}, Allow: true},
+		{Identities: []string{""}, Methods: []string{"Foo.Sum"}, Allow: true},
+	}}
+	for _, tt := range []struct {
+		identity, method string
+		allow            bool
+	}{
+		{"admin", "Foo.Delete", true},
+		{"alice", "Foo.Delete", false},
+		{"alice", "Foo.Sum", true},
+		{"alice", "Bar.Sum", false},
+		{"", "Foo.Sum", true},
+		{"", "Foo.Get", false},
+		{"spiffe://example.org/ns/web", "Foo.Delete", true},
+		{"spiffe://example.com/ns/web", "Foo.Delete", false},
+	} {
+		err := policy.Authorize(&Peer{Identity: tt.identity}, tt.method)
+		_assert((err == nil) == tt.allow && (err == nil || errors.Is(err, ErrPermissionDenied)),
+			"%q calling %s: expect allowed %t, got %v", tt.identity, tt.method, tt.allow, err)
+	}
+}
+
+func TestAuthorization(t *testing.T) {
+	var foo Foo
+	server := NewServer()
+	_ = server.Register(&foo)
+	server.Authorizer = &Policy{Rules: []Rule{{Identities: []string{""}, Methods: []string{"Foo.Sum"}, Allow: true}}}
+	var denied []string
+	server.AuditHook = func(p *Peer, serviceMethod string, err error) {
+		denied = append(denied, serviceMethod)
+	}
+	cc := dialServer(server, DefaultOption)
+	defer func() { _ = cc.Close() }()
+
+	var reply int
+	h, err := callServer(cc, "Foo.Sum", Args{Inta: 1, Intb: 2}, &reply)
+	_assert(err == nil && h.Error == "" && reply == 3, "expect the call to be allowed, got %v %q", err, h.Error)
+	for _, method := range []string{"Foo.Other", "Missing.Method"} {
+		h, err = callServer(cc, method, Args{Inta: 1, Intb: 2}, &reply)
+		_assert(err == nil && strings.HasPrefix(h.Error, ErrPermissionDenied.Error()+": "+method),
+			"expect %s to be denied with a reason, got %v %q", method, err, h.Error)
+	}
+	_assert(len(denied) == 2 && denied[1] == "Missing.Method", "expect the denials to be audited, got %v", denied)
+}
+
+type Failer int
+
+func (f Failer) Coded(n int, reply *int) error {
+	return &Error{Code: CodeInvalidArgument, Message: "n must be positive", Details: codec.Metadata{"field": "n"}}
+}
+
+func (f Failer) Plain(n int, reply *int) error {
+	return errors.New("plain failure")
+}
+
+func (f Failer) Panic(n int, reply *int) error {
+	panic("boom")
+}
+
+func TestErrorCodes(t *testing.T) {
+	server := NewServer()
+	_ = server.Register(new(Failer))
+	_ = server.Register(new(Sleeper))
+	cc := dialServer(server, DefaultOption)
+	defer func() { _ = cc.Close() }()
+	for _, tt := range []struct {
+		method string
+		code   Code
+	}{
+		{"Failer.Coded", CodeInvalidArgument},
+		{"Failer.Plain", CodeUnknown},
+		{"Failer.Panic", CodeInternal},
+		{"Failer.Missing", CodeNotFound},
+		{"Missing.Method", CodeNotFound},
+		{"Sleeper.Sleep", CodeDeadlineExceeded},
+	} {
+		var reply int
+		h, err := callServer(cc, tt.method, 100, &reply)
+		_assert(err == nil && Code(h.Code) == tt.code && h.Error != "", "%s: expect code %s, got %v %s %q", tt.method, tt.code, err, Code(h.Code), h.Error)
+		if tt.method == "Failer.Coded" {
+			_assert(h.Error == "n must be positive" && h.Details["field"] == "n", "expect the message and the details, got %+v", h)
+		}
+	}
+
+	denied := fmt.Errorf("%w: Foo.Sum is denied", ErrPermissionDenied)
+	e := toError(denied)
+	_assert(e.Code == CodePermissionDenied && e.Message == denied.Error(), "expect a wrapped code to be kept, got %+v", e)
+	_assert(errors.Is(e, ErrPermissionDenied) && errors.Is(e, &Error{Code: CodePermissionDenied}), "expect the error to match its sentinel and its code")
+	_assert(!errors.Is(e, ErrServerBusy) && !errors.Is(ErrServerBusy, ErrRateLimited), "expect the codes to tell the errors apart")
+	_assert(toError(context.DeadlineExceeded).Code == CodeDeadlineExceeded, "expect the context errors to be classified")
+	_assert(CodeBusy.String() == "busy" && Code(99).String() == "code 99", "expect the codes to be named")
+}
@@ -1,25 +1,58 @@
 package server
 
 import (
+	"context"
 	"go/ast"
 	"log"
 	"reflect"
 	"sync/atomic"
+	"time"
 )
 
-// methodType denotes the details of method
-type methodType struct {
+// MethodType denotes the details of method
+type MethodType struct {
 	method    reflect.Method
 	ArgType   reflect.Type
 	ReplyType reflect.Type
 	numCalls  uint64
+	numPanics uint64
+	// withContext denotes the method takes a context.Context first
+	withContext bool
+	// stream denotes the method is shaped func(args, *Stream) error
+	stream bool
+	// timeout denotes the handle timeout declared by the service
+	timeout time.Duration
 }
 
-func (m *methodType) NumCalls() uint64 {
+func (m *MethodType) NumCalls() uint64 {
 	return atomic.LoadUint64(&m.numCalls)
 }
 
-func (m *methodType) newArgv() reflect.Value {
+// NumPanics returns how many calls of the method panicked
+func (m *MethodType) NumPanics() uint64 {
+	return atomic.LoadUint64(&m.numPanics)
+}
+
+func (m *MethodType) addPanic() {
+	atomic.AddUint64(&m.numPanics, 1)
+}
+
+// IsStream reports whether the method is a streaming one
+func (m *MethodType) IsStream() bool {
+	return m.stream
+}
+
+// Timeout returns the handle timeout declared for the method, 0 if none
+func (m *MethodType) Timeout() time.Duration {
+	return m.timeout
+}
+
+// Name returns the method name without service prefix
+func (m *MethodType) Name() string {
+	return m.method.Name
+}
+
+func (m *MethodType) newArgv() reflect.Value {
 	var argv reflect.Value
 	if m.ArgType.Kind() == reflect.Ptr {
 		argv = reflect.New(m.ArgType.Elem())
@@ -29,7 +62,7 @@ func (m *methodType) newArgv() reflect.Value {
 	return argv
 }
 
-func (m *methodType) newReplyv() reflect.Value {
+func (m *MethodType) newReplyv() reflect.Value {
 	replyv := reflect.New(m.ReplyType.Elem())
 	switch m.ReplyType.Elem().Kind() {
 	case reflect.Map:
@@ -48,7 +81,7 @@ type service struct {
 	// srv denotes the instance of the struct itself
 	srv reflect.Value
 	// method denote all eligible methods of the struct that store the map
-	method map[string]*methodType
+	method map[string]*MethodType
 }
 
 func newService(srv any) *service {
@@ -60,30 +93,54 @@ func newService(srv any) *service {
 		log.Fatalf("rpc server: %s is not a valid service name", s.name)
 	}
 	s.registerMethods()
+	if t, ok := srv.(HandleTimeouter); ok {
+		for name, timeout := range t.HandleTimeouts() {
+			m, ok := s.method[name]
+			if !ok {
+				log.Printf("rpc server: timeout of unknown method %s.%s\n", s.name, name)
+				continue
+			}
+			m.timeout = timeout
+		}
+	}
 	return s
 }
 
+// HandleTimeouter is implemented by the services declaring handle
+// timeouts for their methods, keyed by method name. They are read
+// once at registration
+type HandleTimeouter interface {
+	HandleTimeouts() map[string]time.Duration
+}
+
+var typeOfContext = reflect.TypeOf((*context.Context)(nil)).Elem()
+
 // registerMethods filters out the appropriate function
-// based on the given input and output parameters
+// based on the given input and output parameters,
+// func(args, *reply) error and the streaming func(args, *Stream) error
+// are accepted, both may take a context.Context first
 func (s *service) registerMethods() {
-	s.method = make(map[string]*methodType)
+	s.method = make(map[string]*MethodType)
 	for i := 0; i < s.typ.NumMethod(); i++ {
 		method := s.typ.Method(i)
 		mType := method.Type
-		if mType.NumIn() != 3 || mType.NumOut() != 1 {
+		withContext := mType.NumIn() == 4 && mType.In(1) == typeOfContext
+		if mType.NumIn() != 3 && !withContext || mType.NumOut() != 1 {
 			continue
 		}
 		if mType.Out(0) != reflect.TypeOf((*error)(nil)).Elem() {
 			continue
 		}
-		argType, replyType := mType.In(1), mType.In(2)
+		argType, replyType := mType.In(mType.NumIn()-2), mType.In(mType.NumIn()-1)
 		if !isExportedOrBuiltinType(argType) || !isExportedOrBuiltinType(replyType) {
 			continue
 		}
-		s.method[method.Name] = &methodType{
-			method:    method,
-			ArgType:   argType,
-			ReplyType: replyType,
+		s.method[method.Name] = &MethodType{
+			method:      method,
+			ArgType:     argType,
+			ReplyType:   replyType,
+			withContext: withContext,
+			stream:      replyType == typeOfStream,
 		}
 		log.Printf("rpc server: register %s.%s\n", s.name, method.Name)
 	}
@@ -93,10 +150,14 @@ func isExportedOrBuiltinType(t reflect.Type) bool {
 	return ast.IsExported(t.Name()) || t.PkgPath() == ""
 }
 
-func (s *service) call(m *methodType, argv, replyv reflect.Value) error {
+func (s *service) call(ctx context.Context, m *MethodType, argv, replyv reflect.Value) error {
 	atomic.AddUint64(&m.numCalls, 1)
 	f := m.method.Func
-	returnValues := f.Call([]reflect.Value{s.srv, argv, replyv})
+	in := []reflect.Value{s.srv, argv, replyv}
+	if m.withContext {
+		in = []reflect.Value{s.srv, reflect.ValueOf(ctx), argv, replyv}
+	}
+	returnValues := f.Call(in)
 	if errInter := returnValues[0].Interface(); errInter != nil {
 		return errInter.(error)
 	}
@@ -0,0 +1,117 @@
+package server
+
+import (
+	"context"
+	"net"
+
+	"github.com/i0Ek3/rpcie/codec"
+)
+
+var ErrServerClosed = Errorf(CodeUnavailable, "rpc server: server is shutting down")
+
+// trackListener adds or removes a listener served by Accept,
+// it reports false if the server is already shut down
+func (server *Server) trackListener(lis net.Listener, add bool) bool {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if !add {
+		delete(server.listeners, lis)
+		return true
+	}
+	if server.inShutdown {
+		return false
+	}
+	if server.listeners == nil {
+		server.listeners = make(map[net.Listener]struct{})
+	}
+	server.listeners[lis] = struct{}{}
+	return true
+}
+
+// trackConn adds or removes a connection served by serveCodec,
+// it reports false if the server is already shut down
+func (server *Server) trackConn(sc *serverConn, add bool) bool {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if !add {
+		delete(server.conns, sc)
+		return true
+	}
+	if server.inShutdown {
+		return false
+	}
+	if server.conns == nil {
+		server.conns = make(map[*serverConn]struct{})
+	}
+	server.conns[sc] = struct{}{}
+	return true
+}
+
+func (server *Server) shuttingDown() bool {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	return server.inShutdown
+}
+
+// closeListeners stops accepting and returns the connections being served
+func (server *Server) closeListeners() (conns []*serverConn, err error) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	server.inShutdown = true
+	for lis := range server.listeners {
+		if cerr := lis.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+		delete(server.listeners, lis)
+	}
+	for sc := range server.conns {
+		conns = append(conns, sc)
+	}
+	return conns, err
+}
+
+// Shutdown gracefully shuts down the server. It stops accepting, tells
+// the clients to stop sending new requests, waits for the requests in
+// flight to be handled and then closes the connections. If ctx expires
+// first, the connections are closed at once and ctx.Err() is returned
+func (server *Server) Shutdown(ctx context.Context) error {
+	conns, err := server.closeListeners()
+	for _, sc := range conns {
+		sc.drain()
+		server.sendResponse(sc, &codec.Header{Kind: codec.KindGoAway}, invalidRequest)
+	}
+	done := make(chan struct{})
+	go func() {
+		for _, sc := range conns {
+			sc.wg.Wait()
+		}
+		close(done)
+	}()
+	select {
+	case <-ctx.Done():
+		err = ctx.Err()
+	case <-done:
+	}
+	for _, sc := range conns {
+		_ = sc.cc.Close()
+	}
+	return err
+}
+
+// Close immediately closes the listeners and the connections of server,
+// the requests in flight see their contexts cancelled
+func (server *Server) Close() error {
+	conns, err := server.closeListeners()
+	for _, sc := range conns {
+		sc.drain()
+		_ = sc.cc.Close()
+	}
+	return err
+}
+
+// drain rejects the requests read from now on
+func (sc *serverConn) drain() {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	sc.draining = true
+}
@@ -0,0 +1,139 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+
+	"github.com/i0Ek3/rpcie/codec"
+)
+
+// streamBuffer denotes how many messages of a stream can be
+// buffered, the stream fails once its method lets them pile up
+const streamBuffer = 64
+
+// ErrStreamOverflow ends the streams whose method doesn't receive the
+// messages of the client, the connection never waits for a method
+var ErrStreamOverflow = Errorf(CodeBusy, "rpc server: stream overflow, the messages are not received")
+
+var typeOfStream = reflect.TypeOf((*Stream)(nil))
+
+// Stream denotes the server side of a streaming call. A streaming
+// method is shaped func(args T, stream *Stream) error, args is the
+// first message sent by the client, the following ones are read
+// with Recv. The stream ends when the method returns
+type Stream struct {
+	server *Server
+	sc     *serverConn
+	h      codec.Header
+	ctx    context.Context
+	// typ denotes the type of the messages read by Recv
+	typ reflect.Type
+	// msgs is fed by the loop reading the connection,
+	// it is closed once the client stops sending
+	msgs   chan reflect.Value
+	done   <-chan struct{}
+	closed bool
+}
+
+func newStream(server *Server, sc *serverConn, req *request, done <-chan struct{}) *Stream {
+	typ := req.mtype.ArgType
+	if typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	return &Stream{
+		server: server,
+		sc:     sc,
+		h:      codec.Header{ServiceMethod: req.h.ServiceMethod, Seq: req.h.Seq, Kind: codec.KindStream},
+		typ:    typ,
+		msgs:   make(chan reflect.Value, streamBuffer),
+		done:   done,
+	}
+}
+
+// Context returns the context of the call, it is done when
+// the client cancels the stream or the connection is closed
+func (s *Stream) Context() context.Context {
+	return s.ctx
+}
+
+// Send sends m to the client as the next message of the stream
+func (s *Stream) Send(m any) error {
+	if err := s.ctx.Err(); err != nil {
+		return err
+	}
+	h := s.h
+	return s.server.sendResponse(s.sc, &h, m)
+}
+
+// Recv reads the next message sent by the client into m, which must be
+// a pointer to the argument type. It returns io.EOF once the client
+// closes its side of the stream
+func (s *Stream) Recv(m any) error {
+	dst := reflect.ValueOf(m)
+	if dst.Kind() != reflect.Ptr || dst.Elem().Type() != s.typ {
+		return fmt.Errorf("rpc server: stream receives %s, got %T", s.typ, m)
+	}
+	select {
+	case v, ok := <-s.msgs:
+		if !ok {
+			return io.EOF
+		}
+		dst.Elem().Set(v.Elem())
+		return nil
+	case <-s.ctx.Done():
+		return s.ctx.Err()
+	}
+}
+
+// readStreamMessage reads a message sent by the client on a stream,
+// messages of unknown, finished or failed streams are discarded. A
+// message which can't be decoded fails its stream
+func (server *Server) readStreamMessage(sc *serverConn, h *codec.Header) error {
+	s := sc.stream(h.Seq)
+	if s == nil || s.closed {
+		return sc.cc.ReadBody(nil)
+	}
+	if h.Kind == codec.KindStreamEnd {
+		s.closed = true
+		close(s.msgs)
+		return sc.cc.ReadBody(nil)
+	}
+	v := reflect.New(s.typ)
+	if err := sc.cc.ReadBody(v.Interface()); err != nil {
+		if !errors.Is(err, codec.ErrBodyTooLarge) {
+			err = &Error{Code: CodeInvalidArgument, Message: err.Error()}
+		}
+		server.failStream(sc, s, err)
+		return err
+	}
+	select {
+	case s.msgs <- v:
+	case <-s.done:
+	default:
+		server.failStream(sc, s, ErrStreamOverflow)
+	}
+	return nil
+}
+
+// failStream ends s with err and cancels its method,
+// the response the method returns is not sent
+func (server *Server) failStream(sc *serverConn, s *Stream, err error) {
+	s.closed = true
+	sc.cancel(s.h.Seq)
+	h := codec.Header{ServiceMethod: s.h.ServiceMethod, Seq: s.h.Seq, Kind: codec.KindStreamEnd}
+	setError(&h, err)
+	server.sendResponse(sc, &h, invalidRequest)
+}
+
+// stream returns the stream of seq being handled
+func (sc *serverConn) stream(seq uint64) *Stream {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if req := sc.requests[seq]; req != nil {
+		return req.stream
+	}
+	return nil
+}
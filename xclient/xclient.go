@@ -15,22 +15,32 @@ import (
 )
 
 type XClient struct {
-	d       Discovery
-	mode    LBStrategy
-	opt     *server.Option
-	mu      sync.Mutex
-	clients map[string]*client.Client
+	d    Discovery
+	mode LBStrategy
+	opt  *server.Option
+	// interceptors wrap Call and Broadcast, the clients
+	// dialed to each server are created without them
+	interceptors []server.UnaryClientInterceptor
+	mu           sync.Mutex
+	clients      map[string]*client.Client
 }
 
 var _ io.Closer = (*XClient)(nil)
 
 func NewXClient(d Discovery, mode LBStrategy, opt *server.Option) *XClient {
-	return &XClient{
+	xc := &XClient{
 		d:       d,
 		mode:    mode,
 		opt:     opt,
 		clients: make(map[string]*client.Client),
 	}
+	if opt != nil && len(opt.Interceptors) > 0 {
+		xc.interceptors = opt.Interceptors
+		o := *opt
+		o.Interceptors = nil
+		xc.opt = &o
+	}
+	return xc
 }
 
 func (xc *XClient) Close() error {
@@ -72,6 +82,10 @@ func (xc *XClient) call(ctx context.Context, rpcAddr string, serviceMethod strin
 }
 
 func (xc *XClient) Call(ctx context.Context, serviceMethod string, args, reply interface{}) error {
+	return client.Chain(xc.interceptors...)(ctx, serviceMethod, args, reply, xc.selectCall)
+}
+
+func (xc *XClient) selectCall(ctx context.Context, serviceMethod string, args, reply interface{}) error {
 	rpcAddr, err := xc.d.Get(xc.mode)
 	if err != nil {
 		return err
@@ -80,6 +94,10 @@ func (xc *XClient) Call(ctx context.Context, serviceMethod string, args, reply i
 }
 
 func (xc *XClient) Broadcast(ctx context.Context, serviceMethod string, args, reply interface{}) error {
+	return client.Chain(xc.interceptors...)(ctx, serviceMethod, args, reply, xc.broadcast)
+}
+
+func (xc *XClient) broadcast(ctx context.Context, serviceMethod string, args, reply interface{}) error {
 	servers, err := xc.d.GetAll()
 	if err != nil {
 		return err